@@ -0,0 +1,274 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// breakpointAction is the action taken on a function call paused at a
+// breakpoint.
+type breakpointAction int
+
+const (
+	// breakpointRelease forwards the function call to the local
+	// application, possibly with an edited input.
+	breakpointRelease breakpointAction = iota
+	// breakpointSkip responds to the function call with an error instead
+	// of forwarding it.
+	breakpointSkip
+)
+
+// breakpoints holds function calls before they're forwarded to the local
+// application, when a breakpoint is set on their function. Breakpoints are
+// set, and paused function calls are resumed, from the TUI.
+type breakpoints struct {
+	mu        sync.Mutex
+	functions map[string]struct{}
+	paused    map[DispatchID]*pausedCall
+
+	// onPause, if set, is called when a function call is paused. Paused
+	// calls aren't observed until they're released, since their input
+	// may be edited in the meantime.
+	onPause func(time.Time, *sdkv1.RunRequest)
+}
+
+type pausedCall struct {
+	function string
+	request  *sdkv1.RunRequest
+	resumed  chan struct{}
+	action   breakpointAction
+	input    *anypb.Any
+}
+
+func newBreakpoints() *breakpoints {
+	return &breakpoints{
+		functions: map[string]struct{}{},
+		paused:    map[DispatchID]*pausedCall{},
+	}
+}
+
+// toggle sets a breakpoint on the function, or removes it if it was
+// already set, in which case function calls paused at the breakpoint are
+// released. It returns true if the breakpoint was set.
+func (b *breakpoints) toggle(function string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.functions[function]; !ok {
+		b.functions[function] = struct{}{}
+		return true
+	}
+	delete(b.functions, function)
+	for id, c := range b.paused {
+		if c.function == function {
+			b.resume(id, c, breakpointRelease, nil)
+		}
+	}
+	return false
+}
+
+// list returns the functions that have a breakpoint, in alphabetical order.
+func (b *breakpoints) list() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	functions := make([]string, 0, len(b.functions))
+	for function := range b.functions {
+		functions = append(functions, function)
+	}
+	slices.Sort(functions)
+	return functions
+}
+
+// isPaused returns true if the function call is paused at a breakpoint.
+func (b *breakpoints) isPaused(id DispatchID) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.paused[id]
+	return ok
+}
+
+// pausedRequest returns the request of a function call paused at a
+// breakpoint, or nil if the function call isn't paused.
+func (b *breakpoints) pausedRequest(id DispatchID) *sdkv1.RunRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c, ok := b.paused[id]; ok {
+		return c.request
+	}
+	return nil
+}
+
+// wait holds the function call if a breakpoint is set on its function,
+// until it's resumed or the context is canceled. It returns the action to
+// take, and the edited input of the function call, if any.
+func (b *breakpoints) wait(ctx context.Context, req *sdkv1.RunRequest, logger *slog.Logger) (breakpointAction, *anypb.Any, error) {
+	if b == nil {
+		return breakpointRelease, nil, nil
+	}
+
+	b.mu.Lock()
+	if _, ok := b.functions[req.Function]; !ok {
+		b.mu.Unlock()
+		return breakpointRelease, nil, nil
+	}
+	id := DispatchID(req.DispatchId)
+	c := &pausedCall{function: req.Function, request: req, resumed: make(chan struct{})}
+	b.paused[id] = c
+	onPause := b.onPause
+	b.mu.Unlock()
+
+	if onPause != nil {
+		onPause(time.Now(), req)
+	}
+	logger.Info("function call paused at breakpoint", "function", req.Function)
+	select {
+	case <-c.resumed:
+		switch {
+		case c.action == breakpointSkip:
+			logger.Info("function call skipped at breakpoint", "function", req.Function)
+		case c.input != nil:
+			logger.Info("function call released with edited input", "function", req.Function)
+		default:
+			logger.Info("function call released", "function", req.Function)
+		}
+		return c.action, c.input, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		if b.paused[id] == c {
+			delete(b.paused, id)
+		}
+		b.mu.Unlock()
+		return breakpointRelease, nil, ctx.Err()
+	}
+}
+
+// release forwards a function call paused at a breakpoint to the local
+// application. If input is not nil, it replaces the input of the call.
+func (b *breakpoints) release(id DispatchID, input *anypb.Any) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.paused[id]
+	if ok {
+		b.resume(id, c, breakpointRelease, input)
+	}
+	return ok
+}
+
+// skip responds to a function call paused at a breakpoint with an error.
+func (b *breakpoints) skip(id DispatchID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.paused[id]
+	if ok {
+		b.resume(id, c, breakpointSkip, nil)
+	}
+	return ok
+}
+
+// resume resumes a paused function call. The caller must hold b.mu.
+func (b *breakpoints) resume(id DispatchID, c *pausedCall, action breakpointAction, input *anypb.Any) {
+	delete(b.paused, id)
+	c.action = action
+	c.input = input
+	close(c.resumed)
+}
+
+// inputJSON returns the input of a function call as JSON, so that it can
+// be edited. Only inputs encoded as well-known types can be edited.
+func inputJSON(req *sdkv1.RunRequest) (string, error) {
+	input := req.GetInput()
+	if input == nil {
+		return "", fmt.Errorf("function call has no input to edit")
+	}
+	m, err := input.UnmarshalNew()
+	if err != nil {
+		return "", fmt.Errorf("cannot edit input: %v", err)
+	}
+
+	var v any
+	switch mm := m.(type) {
+	case *wrapperspb.BoolValue:
+		v = mm.Value
+	case *wrapperspb.Int32Value:
+		v = mm.Value
+	case *wrapperspb.Int64Value:
+		v = mm.Value
+	case *wrapperspb.UInt32Value:
+		v = mm.Value
+	case *wrapperspb.UInt64Value:
+		v = mm.Value
+	case *wrapperspb.FloatValue:
+		v = mm.Value
+	case *wrapperspb.DoubleValue:
+		v = mm.Value
+	case *wrapperspb.StringValue:
+		v = mm.Value
+	case *emptypb.Empty:
+		v = nil
+	case *structpb.Struct:
+		v = mm.AsMap()
+	case *structpb.ListValue:
+		v = mm.AsSlice()
+	case *structpb.Value:
+		v = mm.AsInterface()
+	default:
+		return "", fmt.Errorf("cannot edit input of type %s", typeName(input.TypeUrl))
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("cannot edit input: %v", err)
+	}
+	return string(b), nil
+}
+
+// parseInputJSON parses the edited input of a function call. Numbers keep
+// the floating point type of the original input, if any.
+func parseInputJSON(original *anypb.Any, s string) (*anypb.Any, error) {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid input: %v", err)
+	}
+	if d.More() {
+		return nil, fmt.Errorf("invalid input: unexpected data after the value")
+	}
+
+	switch n := v.(type) {
+	case nil:
+		return anypb.New(&emptypb.Empty{})
+	case json.Number:
+		if original.MessageIs(&wrapperspb.DoubleValue{}) || original.MessageIs(&wrapperspb.FloatValue{}) {
+			f, err := n.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("invalid input: %v", err)
+			}
+			if original.MessageIs(&wrapperspb.FloatValue{}) {
+				return anypb.New(wrapperspb.Float(float32(f)))
+			}
+			return anypb.New(wrapperspb.Double(f))
+		}
+	}
+	return newAny(v)
+}
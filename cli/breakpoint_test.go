@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestBreakpoints(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(&slogHandler{stream: io.Discard})
+
+	bp := newBreakpoints()
+	assert.True(t, bp.toggle("work"))
+	assert.Equal(t, []string{"work"}, bp.list())
+
+	// Calls to other functions are not paused.
+	action, input, err := bp.wait(ctx, &sdkv1.RunRequest{Function: "other", DispatchId: "0"}, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, breakpointRelease, action)
+	assert.Nil(t, input)
+
+	waitAsync := func(id string) <-chan breakpointAction {
+		actions := make(chan breakpointAction, 1)
+		go func() {
+			action, _, _ := bp.wait(ctx, &sdkv1.RunRequest{Function: "work", DispatchId: id}, logger)
+			actions <- action
+		}()
+		assert.Eventually(t, func() bool { return bp.isPaused(DispatchID(id)) }, time.Second, time.Millisecond)
+		return actions
+	}
+
+	actions := waitAsync("1")
+	assert.True(t, bp.skip("1"))
+	assert.Equal(t, breakpointSkip, <-actions)
+	assert.False(t, bp.isPaused("1"))
+	assert.False(t, bp.skip("1"))
+
+	actions = waitAsync("2")
+	assert.True(t, bp.release("2", nil))
+	assert.Equal(t, breakpointRelease, <-actions)
+
+	// Removing the breakpoint releases the paused calls.
+	actions = waitAsync("3")
+	assert.False(t, bp.toggle("work"))
+	assert.Equal(t, breakpointRelease, <-actions)
+	assert.Empty(t, bp.list())
+
+	// Paused calls are abandoned when the context is canceled.
+	bp.toggle("work")
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		_, _, err := bp.wait(ctx, &sdkv1.RunRequest{Function: "work", DispatchId: "4"}, logger)
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { return bp.isPaused("4") }, time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.False(t, bp.isPaused("4"))
+
+	var nilBreakpoints *breakpoints
+	_, _, err = nilBreakpoints.wait(ctx, &sdkv1.RunRequest{Function: "work"}, logger)
+	assert.NoError(t, err)
+}
+
+func TestEditInput(t *testing.T) {
+	tests := []struct {
+		input  proto.Message
+		json   string
+		edited string
+		output proto.Message
+	}{
+		{input: wrapperspb.String("hello"), json: `"hello"`, edited: `"world"`, output: wrapperspb.String("world")},
+		{input: wrapperspb.Int64(1), json: `1`, edited: `2`, output: wrapperspb.Int64(2)},
+		{input: wrapperspb.Double(1.5), json: `1.5`, edited: `2`, output: wrapperspb.Double(2)},
+		{input: wrapperspb.Bool(true), json: `true`, edited: `false`, output: wrapperspb.Bool(false)},
+		{
+			input:  mustStruct(t, map[string]any{"a": 1.0}),
+			json:   `{"a":1}`,
+			edited: `{"a": 2, "b": "c"}`,
+			output: mustStruct(t, map[string]any{"a": 2.0, "b": "c"}),
+		},
+	}
+	for _, test := range tests {
+		input, err := anypb.New(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &sdkv1.RunRequest{Directive: &sdkv1.RunRequest_Input{Input: input}}
+
+		s, err := inputJSON(req)
+		assert.NoError(t, err)
+		assert.Equal(t, test.json, s)
+
+		edited, err := parseInputJSON(input, test.edited)
+		assert.NoError(t, err)
+		m, err := edited.UnmarshalNew()
+		assert.NoError(t, err)
+		assert.True(t, proto.Equal(test.output, m), "expected %v, got %v", test.output, m)
+	}
+
+	// Pickled Python values cannot be edited.
+	input, err := anypb.New(wrapperspb.Bytes([]byte{0x80, 0x04}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = inputJSON(&sdkv1.RunRequest{Directive: &sdkv1.RunRequest_Input{Input: input}})
+	assert.Error(t, err)
+
+	_, err = parseInputJSON(input, `{"a": `)
+	assert.Error(t, err)
+}
+
+func TestCallEndpointBreakpoint(t *testing.T) {
+	inputs := make(chan *sdkv1.RunRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(body, &req); err == nil {
+			inputs <- &req
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	oldEndpoint := LocalEndpoint
+	LocalEndpoint = server.Listener.Addr().String()
+	defer func() { LocalEndpoint = oldEndpoint }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	logger := slog.New(&slogHandler{stream: io.Discard})
+
+	bp := newBreakpoints()
+	bp.toggle("work")
+	var recording bytes.Buffer
+	recorder := newSessionRecorder(&recording)
+
+	call := func(id string) <-chan *sdkv1.RunResponse {
+		input, err := anypb.New(wrapperspb.String("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &sdkv1.RunRequest{Function: "work", DispatchId: id, Directive: &sdkv1.RunRequest_Input{Input: input}}
+		body, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		responses := make(chan *sdkv1.RunResponse, 1)
+		go func() {
+			_, res, _ := callEndpoint(ctx, http.DefaultClient, newEndpointRequest(ctx, body), req, logger, recorder, bp)
+			responses <- res
+		}()
+		assert.Eventually(t, func() bool { return bp.isPaused(DispatchID(id)) }, time.Second, time.Millisecond)
+		return responses
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		responses := call("1")
+		bp.skip("1")
+		res := <-responses
+		assert.Equal(t, sdkv1.Status_STATUS_PERMANENT_ERROR, res.Status)
+		assert.Empty(t, inputs)
+	})
+
+	t.Run("edit", func(t *testing.T) {
+		responses := call("2")
+		edited, err := anypb.New(wrapperspb.String("world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp.release("2", edited)
+		<-responses
+
+		req := <-inputs
+		var input wrapperspb.StringValue
+		if err := req.GetInput().UnmarshalTo(&input); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "world", input.Value)
+
+		// Observers see the edited input, rather than the original one.
+		records, err := readSessionRecords(&recording)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var observed []*sdkv1.RunRequest
+		for _, record := range records {
+			if record.Type == requestRecord && record.DispatchID == "2" {
+				var req sdkv1.RunRequest
+				if err := proto.Unmarshal(record.Request, &req); err != nil {
+					t.Fatal(err)
+				}
+				observed = append(observed, &req)
+			}
+		}
+		if assert.Len(t, observed, 1) {
+			assert.True(t, proto.Equal(req, observed[0]))
+		}
+	})
+}
+
+func mustStruct(t *testing.T, m map[string]any) *structpb.Struct {
+	s, err := structpb.NewStruct(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
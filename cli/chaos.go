@@ -0,0 +1,203 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ChaosFaults    []string
+	ChaosRate      float64
+	ChaosFunctions []string
+	ChaosDelay     time.Duration
+)
+
+const (
+	defaultChaosRate  = 10
+	defaultChaosDelay = 5 * time.Second
+)
+
+// fault is a fault that can be injected in function calls forwarded to the
+// local application, to exercise the retry behavior of Dispatch.
+type fault string
+
+const (
+	// faultDrop drops the request: it's neither forwarded to the local
+	// application nor responded to, so Dispatch eventually times out.
+	faultDrop fault = "drop"
+	// faultDelay delays the request before forwarding it.
+	faultDelay fault = "delay"
+	// faultError responds with a STATUS_TEMPORARY_ERROR instead of
+	// forwarding the request.
+	faultError fault = "error"
+	// faultUnavailable responds with an HTTP 503 instead of forwarding the
+	// request.
+	faultUnavailable fault = "unavailable"
+	// faultCut forwards the request, and cuts the response sent back to
+	// Dispatch in the middle of its body.
+	faultCut fault = "cut"
+)
+
+var faults = []fault{faultDrop, faultDelay, faultError, faultUnavailable, faultCut}
+
+// faultInjector decides which faults to inject in function calls.
+type faultInjector struct {
+	faults    []fault
+	rate      float64
+	functions []string
+	delay     time.Duration
+
+	// random returns a pseudo-random number in [0,1).
+	random func() float64
+}
+
+// newFaultInjector creates a faultInjector that injects one of the faults
+// in the specified percentage of function calls. If functions are
+// specified, faults are only injected in calls to these functions. It
+// returns nil if no faults are specified.
+func newFaultInjector(names []string, rate float64, functions []string, delay time.Duration) (*faultInjector, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	f := &faultInjector{
+		rate:      rate / 100,
+		functions: functions,
+		delay:     delay,
+		random:    rand.Float64,
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(faults, fault(name)) {
+			return nil, fmt.Errorf("invalid fault: %q (expected drop, delay, error, unavailable or cut)", name)
+		}
+		if !slices.Contains(f.faults, fault(name)) {
+			f.faults = append(f.faults, fault(name))
+		}
+	}
+	if rate < 0 || rate > 100 {
+		return nil, fmt.Errorf("invalid chaos rate: %v (expected a percentage between 0 and 100)", rate)
+	}
+	if delay < 0 {
+		return nil, fmt.Errorf("invalid chaos delay: %v", delay)
+	}
+	return f, nil
+}
+
+// fault returns the fault to inject in a call to the function, or an empty
+// string if the call should be forwarded normally.
+func (f *faultInjector) fault(function string) fault {
+	if f == nil {
+		return ""
+	}
+	if len(f.functions) > 0 && !slices.Contains(f.functions, function) {
+		return ""
+	}
+	if f.random() >= f.rate {
+		return ""
+	}
+	return f.faults[int(f.random()*float64(len(f.faults)))%len(f.faults)]
+}
+
+// faultResponse returns the synthetic response of the local application
+// for faults that respond in its place.
+func faultResponse(f fault) (*http.Response, *sdkv1.RunResponse) {
+	switch f {
+	case faultError:
+		runResponse := &sdkv1.RunResponse{
+			Status: sdkv1.Status_STATUS_TEMPORARY_ERROR,
+			Directive: &sdkv1.RunResponse_Exit{
+				Exit: &sdkv1.Exit{
+					Result: &sdkv1.CallResult{
+						Error: &sdkv1.Error{
+							Type:    "ChaosError",
+							Message: "fault injected by dispatch run --chaos",
+						},
+					},
+				},
+			},
+		}
+		return syntheticRunResponse(runResponse), runResponse
+	case faultUnavailable:
+		body := []byte(http.StatusText(http.StatusServiceUnavailable))
+		return syntheticResponse(http.StatusServiceUnavailable, "text/plain", body), nil
+	default:
+		return nil, nil
+	}
+}
+
+// syntheticRunResponse creates a response carrying a RunResponse generated
+// by the CLI in place of the local application.
+func syntheticRunResponse(runResponse *sdkv1.RunResponse) *http.Response {
+	body, err := proto.Marshal(runResponse)
+	if err != nil {
+		panic(err)
+	}
+	return syntheticResponse(http.StatusOK, "application/proto", body)
+}
+
+// syntheticHeader marks responses generated by the CLI, so that observers
+// can tell them apart from the responses of the local application. It's
+// removed before responses are sent to Dispatch.
+const syntheticHeader = "X-Dispatch-Cli-Synthetic"
+
+// syntheticResponse creates a response generated by the CLI in place of
+// the local application.
+func syntheticResponse(statusCode int, contentType string, body []byte) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode: statusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":  []string{contentType},
+			syntheticHeader: []string{"true"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// isSynthetic returns true if the response to a function call was generated
+// by the CLI, or if the function call was dropped, i.e. if the request
+// wasn't handled by the local application.
+func isSynthetic(err error, res *http.Response) bool {
+	return errors.Is(err, faultDrop) || (res != nil && res.Header.Get(syntheticHeader) != "")
+}
+
+// writeCutResponse writes the response up to the middle of its body, and
+// returns an error to abort the request that carries it.
+func writeCutResponse(w io.Writer, res *http.Response) error {
+	var b bytes.Buffer
+	if err := res.Write(&b); err != nil {
+		return err
+	}
+	n := b.Len() - max(int(res.ContentLength)/2, 1)
+	if _, err := w.Write(b.Bytes()[:n]); err != nil {
+		return err
+	}
+	return faultCut
+}
+
+// Error implements the error interface, so that faults can be reported
+// in place of the response of the local application.
+func (f fault) Error() string {
+	switch f {
+	case faultDrop:
+		return "Request dropped (--chaos)"
+	case faultCut:
+		return "Response cut (--chaos)"
+	default:
+		return fmt.Sprintf("Fault injected (--chaos): %s", string(f))
+	}
+}
@@ -0,0 +1,186 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFaultInjector(t *testing.T) {
+	_, err := newFaultInjector([]string{"explode"}, 10, nil, 0)
+	assert.Error(t, err)
+	_, err = newFaultInjector([]string{"drop"}, 101, nil, 0)
+	assert.Error(t, err)
+
+	f, err := newFaultInjector(nil, 10, nil, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+	assert.Equal(t, fault(""), f.fault("work"))
+
+	f, err = newFaultInjector([]string{"drop", "error"}, 50, []string{"work"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.random = func() float64 { return 0.75 }
+	assert.Equal(t, fault(""), f.fault("work"))
+
+	f.random = func() float64 { return 0.25 }
+	assert.Equal(t, faultDrop, f.fault("work"))
+	assert.Equal(t, fault(""), f.fault("other"))
+
+	random := []float64{0.25, 0.75}
+	f.random = func() float64 {
+		r := random[0]
+		random = random[1:]
+		return r
+	}
+	assert.Equal(t, faultError, f.fault("work"))
+}
+
+func TestWriteCutResponse(t *testing.T) {
+	res, _ := faultResponse(faultUnavailable)
+
+	var b bytes.Buffer
+	err := writeCutResponse(&b, res)
+	assert.Equal(t, faultCut, err)
+
+	// The headers are intact, but the body is truncated.
+	cut, err := http.ReadResponse(bufio.NewReader(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, cut.StatusCode)
+	_, err = io.ReadAll(cut.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestInvokeChaos(t *testing.T) {
+	var endpointCalls atomic.Int64
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpointCalls.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer endpoint.Close()
+
+	responses := make(chan *http.Response, 1)
+	bridge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := http.ReadResponse(bufio.NewReader(r.Body), nil)
+		if err == nil {
+			responses <- res
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer bridge.Close()
+
+	oldEndpoint := LocalEndpoint
+	LocalEndpoint = endpoint.Listener.Addr().String()
+	defer func() { LocalEndpoint = oldEndpoint }()
+
+	bridgeGetRes := func() *http.Response {
+		body, err := proto.Marshal(&sdkv1.RunRequest{Function: "work"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://example.com/dispatch.sdk.v1.FunctionService/Run", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/proto")
+
+		var b bytes.Buffer
+		if err := req.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(&b)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := newHTTPClient(time.Second)
+
+	t.Run("error", func(t *testing.T) {
+		chaos, err := newFaultInjector([]string{"error"}, 100, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = invoke(ctx, client, client, bridge.URL, "1", bridgeGetRes(), chaos, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := <-responses
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Empty(t, res.Header.Get(syntheticHeader))
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runResponse sdkv1.RunResponse
+		if err := proto.Unmarshal(body, &runResponse); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, sdkv1.Status_STATUS_TEMPORARY_ERROR, runResponse.Status)
+		assert.Equal(t, int64(0), endpointCalls.Load())
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		chaos, err := newFaultInjector([]string{"unavailable"}, 100, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = invoke(ctx, client, client, bridge.URL, "2", bridgeGetRes(), chaos, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := <-responses
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.Equal(t, int64(0), endpointCalls.Load())
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		chaos, err := newFaultInjector([]string{"drop"}, 100, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = invoke(ctx, client, client, bridge.URL, "3", bridgeGetRes(), chaos, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Empty(t, responses)
+		assert.Equal(t, int64(0), endpointCalls.Load())
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		chaos, err := newFaultInjector([]string{"delay"}, 100, nil, 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		err = invoke(ctx, client, client, bridge.URL, "4", bridgeGetRes(), chaos, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+		res := <-responses
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, int64(1), endpointCalls.Load())
+	})
+}
@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// concurrencyLimiter bounds the number of requests that are sent to the
+// local application concurrently, and keeps track of the number of requests
+// that are in-flight or waiting for their turn.
+type concurrencyLimiter struct {
+	// max is the maximum number of concurrent requests, or zero if the
+	// number of concurrent requests is unbounded.
+	max int
+
+	mu       sync.Mutex
+	cond     sync.Cond
+	inflight int
+	queued   int
+	// reserved is the number of slots reserved for requests that have yet
+	// to be retrieved. They're part of inflight, but not reported as such.
+	reserved int
+}
+
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	l := &concurrencyLimiter{max: max}
+	l.cond.L = &l.mu
+	return l
+}
+
+// acquire blocks until a request can be sent to the local application.
+// It returns false if the context was canceled before then, in which
+// case release must not be called.
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.wait(ctx, true)
+}
+
+// reserve blocks until a request can be sent to the local application,
+// before the request is retrieved, so that requests are not retrieved from
+// Dispatch only to wait for their turn. It returns false if the context was
+// canceled before then. Otherwise, the slot must either be claimed once a
+// request is retrieved, or given back with unreserve.
+func (l *concurrencyLimiter) reserve(ctx context.Context) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.wait(ctx, false) {
+		return false
+	}
+	l.reserved++
+	return true
+}
+
+// claim uses a reserved slot for a request, which must then be released
+// with release once it has completed.
+func (l *concurrencyLimiter) claim() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reserved--
+}
+
+// unreserve gives back a reserved slot that wasn't claimed.
+func (l *concurrencyLimiter) unreserve() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reserved--
+	l.inflight--
+	l.cond.Broadcast()
+}
+
+// wait waits for a free slot and takes it. Requests waiting for a slot are
+// counted as queued if queue is true. The caller must hold l.mu.
+func (l *concurrencyLimiter) wait(ctx context.Context, queue bool) bool {
+	if l.max > 0 && l.inflight >= l.max {
+		// Wake up waiters when the context is canceled.
+		stop := context.AfterFunc(ctx, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.cond.Broadcast()
+		})
+		defer stop()
+
+		if queue {
+			l.queued++
+			defer func() { l.queued-- }()
+		}
+		for l.inflight >= l.max && ctx.Err() == nil {
+			l.cond.Wait()
+		}
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// release is called when a request acquired with acquire has completed.
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+	l.cond.Broadcast()
+}
+
+// counts returns the number of in-flight and queued requests.
+func (l *concurrencyLimiter) counts() (inflight, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.inflight - l.reserved, l.queued
+}
+
+// drain waits until there are no in-flight or queued requests, the timeout
+// expires, skip is closed, or the context is canceled. It returns the number
+// of requests that are still in-flight or queued.
+func (l *concurrencyLimiter) drain(ctx context.Context, timeout time.Duration, skip <-chan struct{}) int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		inflight, queued := l.counts()
+		if inflight+queued == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return inflight + queued
+		case <-skip:
+			return inflight + queued
+		case <-timer.C:
+			return inflight + queued
+		case <-ticker.C:
+		}
+	}
+}
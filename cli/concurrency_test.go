@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := newConcurrencyLimiter(1)
+
+	assert.True(t, l.acquire(ctx))
+
+	acquired := make(chan bool)
+	go func() { acquired <- l.acquire(ctx) }()
+
+	assert.Eventually(t, func() bool {
+		inflight, queued := l.counts()
+		return inflight == 1 && queued == 1
+	}, time.Second, time.Millisecond)
+
+	l.release()
+	assert.True(t, <-acquired)
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() { acquired <- l.acquire(ctx) }()
+	cancel()
+	assert.False(t, <-acquired)
+
+	inflight, queued := l.counts()
+	assert.Equal(t, 1, inflight)
+	assert.Equal(t, 0, queued)
+}
+
+func TestConcurrencyLimiterReserve(t *testing.T) {
+	ctx := context.Background()
+	l := newConcurrencyLimiter(1)
+
+	// Reserved slots are not reported as in-flight requests, but they
+	// prevent other requests from being sent.
+	assert.True(t, l.reserve(ctx))
+	inflight, queued := l.counts()
+	assert.Equal(t, 0, inflight)
+	assert.Equal(t, 0, queued)
+
+	reserved := make(chan bool)
+	go func() { reserved <- l.reserve(ctx) }()
+	select {
+	case <-reserved:
+		t.Fatal("slot reserved twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.unreserve()
+	assert.True(t, <-reserved)
+
+	// A claimed slot is an in-flight request until it's released.
+	l.claim()
+	inflight, _ = l.counts()
+	assert.Equal(t, 1, inflight)
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() { reserved <- l.reserve(ctx) }()
+	cancel()
+	assert.False(t, <-reserved)
+
+	l.release()
+	inflight, queued = l.counts()
+	assert.Equal(t, 0, inflight)
+	assert.Equal(t, 0, queued)
+}
+
+func TestConcurrencyLimiterDrain(t *testing.T) {
+	ctx := context.Background()
+	l := newConcurrencyLimiter(0)
+
+	assert.Equal(t, 0, l.drain(ctx, time.Hour, nil))
+
+	// The drain completes once in-flight requests are released.
+	assert.True(t, l.acquire(ctx))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.release()
+	}()
+	assert.Equal(t, 0, l.drain(ctx, time.Hour, nil))
+
+	// Requests are abandoned when the timeout expires, or when the drain
+	// is skipped.
+	assert.True(t, l.acquire(ctx))
+	assert.Equal(t, 1, l.drain(ctx, 10*time.Millisecond, nil))
+
+	skip := make(chan struct{})
+	close(skip)
+	assert.Equal(t, 1, l.drain(ctx, time.Hour, skip))
+}
@@ -0,0 +1,177 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var (
+	EndpointCAFile   string
+	EndpointInsecure bool
+	EndpointH2C      bool
+)
+
+const (
+	// unixEndpointPrefix is the prefix of --endpoint values that refer to a
+	// unix domain socket rather than a TCP address, e.g. unix:///tmp/app.sock.
+	unixEndpointPrefix = "unix://"
+
+	// httpsEndpointPrefix is the prefix of --endpoint values that refer to
+	// a local application endpoint serving HTTPS, e.g. https://localhost:8443.
+	httpsEndpointPrefix = "https://"
+	httpEndpointPrefix  = "http://"
+
+	// autoEndpoint is the --endpoint value that picks a free port.
+	autoEndpoint = "auto"
+)
+
+// endpointAddr returns the network and address that the local application
+// endpoint is listening on.
+func endpointAddr(endpoint string) (network, address string) {
+	if path, ok := strings.CutPrefix(endpoint, unixEndpointPrefix); ok {
+		return "unix", path
+	}
+	if address, ok := strings.CutPrefix(endpoint, httpsEndpointPrefix); ok {
+		return "tcp", address
+	}
+	address, _ = strings.CutPrefix(endpoint, httpEndpointPrefix)
+	return "tcp", address
+}
+
+func validateEndpoint(endpoint string) error {
+	switch network, address := endpointAddr(endpoint); {
+	case address == "":
+		return fmt.Errorf("invalid endpoint: %q", endpoint)
+	case network == "tcp":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("invalid endpoint: %v", err)
+		}
+	}
+
+	if endpointScheme() == "https" {
+		if EndpointH2C {
+			return fmt.Errorf("--endpoint-h2c cannot be used with an https:// endpoint")
+		}
+	} else if EndpointCAFile != "" || EndpointInsecure {
+		return fmt.Errorf("--endpoint-ca and --endpoint-insecure require an https:// endpoint")
+	}
+	return nil
+}
+
+// freeEndpoint returns the address of a free port on the loopback
+// interface.
+//
+// The port is released before the local application starts, so another
+// process could grab it in the meantime, though this is unlikely.
+func freeEndpoint() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate a port for the local endpoint: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// endpointScheme returns the scheme of the URLs of requests sent to the
+// local application.
+func endpointScheme() string {
+	if strings.HasPrefix(LocalEndpoint, httpsEndpointPrefix) {
+		return "https"
+	}
+	return "http"
+}
+
+// endpointHost returns the host of the URLs of requests sent to the local
+// application. Requests sent to a unix domain socket use localhost, since
+// they must have a valid host.
+func endpointHost() string {
+	network, address := endpointAddr(LocalEndpoint)
+	if network == "unix" {
+		return "localhost"
+	}
+	return address
+}
+
+// endpointRequestURL returns the URL of a request to the local application.
+func endpointRequestURL(path string) string {
+	return endpointScheme() + "://" + endpointHost() + path
+}
+
+// endpointURL returns the URL that the local application endpoint can be
+// reached at, as exported to the local application.
+func endpointURL() string {
+	if network, _ := endpointAddr(LocalEndpoint); network == "unix" {
+		return LocalEndpoint
+	}
+	return endpointScheme() + "://" + endpointHost()
+}
+
+// endpointListenAddr returns the address that the local application should
+// listen on, as exported to the local application. It's the path of the
+// socket for unix domain sockets, or the host:port otherwise.
+func endpointListenAddr() string {
+	_, address := endpointAddr(LocalEndpoint)
+	return address
+}
+
+// newEndpointClient creates an HTTP client for requests to the local
+// application, with the specified timeout. A zero timeout means no timeout.
+func newEndpointClient(timeout time.Duration) (*http.Client, error) {
+	client := newHTTPClient(timeout)
+	network, address := endpointAddr(LocalEndpoint)
+
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	if network == "unix" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		}
+	}
+
+	if EndpointH2C {
+		// HTTP/2 over cleartext, with prior knowledge, which is how HTTP/2
+		// servers are usually exposed behind a TLS-terminating proxy.
+		client.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, address string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, address)
+			},
+		}
+		return client, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dial
+	if endpointScheme() == "https" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: EndpointInsecure}
+		if EndpointCAFile != "" {
+			pem, err := os.ReadFile(EndpointCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read endpoint CA: %v", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("failed to read endpoint CA: no certificates found in %s", EndpointCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	client.Transport = transport
+	return client, nil
+}
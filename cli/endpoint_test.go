@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestValidateEndpoint(t *testing.T) {
+	assert.NoError(t, validateEndpoint("127.0.0.1:8000"))
+	assert.NoError(t, validateEndpoint("unix:///tmp/app.sock"))
+	assert.Error(t, validateEndpoint("127.0.0.1"))
+	assert.Error(t, validateEndpoint("unix://"))
+}
+
+func TestUnixEndpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, runPath, r.URL.Path)
+		b, _ := proto.Marshal(&sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK})
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	LocalEndpoint = "unix://" + path
+	defer func() { LocalEndpoint = defaultEndpoint }()
+
+	assert.Equal(t, path, endpointListenAddr())
+	assert.True(t, checkEndpoint(LocalEndpoint, time.Second))
+
+	ctx := context.Background()
+	req := &sdkv1.RunRequest{Function: "a"}
+	logger := slog.New(&slogHandler{stream: io.Discard})
+	client, err := newEndpointClient(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, res, err := callEndpoint(ctx, client, newEndpointRequest(ctx, nil), req, logger, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, sdkv1.Status_STATUS_OK, res.GetStatus())
+}
+
+func TestHTTPSEndpoint(t *testing.T) {
+	var protocol string
+	app := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocol = r.Proto
+		b, _ := proto.Marshal(&sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK})
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	}))
+	app.EnableHTTP2 = true
+	app.StartTLS()
+	defer app.Close()
+
+	LocalEndpoint = app.URL
+	defer func() { LocalEndpoint = defaultEndpoint }()
+	defer func() { EndpointCAFile, EndpointInsecure = "", false }()
+
+	call := func() error {
+		client, err := newEndpointClient(time.Second)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		logger := slog.New(&slogHandler{stream: io.Discard})
+		_, _, err = callEndpoint(ctx, client, newEndpointRequest(ctx, nil), &sdkv1.RunRequest{}, logger, nil, nil)
+		return err
+	}
+
+	t.Run("Untrusted certificate", func(t *testing.T) {
+		assert.Error(t, call())
+	})
+
+	t.Run("CA", func(t *testing.T) {
+		EndpointCAFile = filepath.Join(t.TempDir(), "ca.pem")
+		cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: app.Certificate().Raw})
+		assert.NoError(t, os.WriteFile(EndpointCAFile, cert, 0644))
+		assert.NoError(t, call())
+		assert.Equal(t, "HTTP/2.0", protocol)
+	})
+
+	t.Run("Insecure", func(t *testing.T) {
+		EndpointCAFile, EndpointInsecure = "", true
+		assert.NoError(t, call())
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		EndpointH2C = true
+		defer func() { EndpointH2C = false }()
+		assert.Error(t, validateEndpoint(LocalEndpoint))
+	})
+}
+
+func TestH2CEndpoint(t *testing.T) {
+	var protocol string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocol = r.Proto
+		b, _ := proto.Marshal(&sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK})
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	})
+	app := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer app.Close()
+
+	LocalEndpoint = app.Listener.Addr().String()
+	EndpointH2C = true
+	defer func() { LocalEndpoint, EndpointH2C = defaultEndpoint, false }()
+
+	client, err := newEndpointClient(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	logger := slog.New(&slogHandler{stream: io.Discard})
+	_, res, err := callEndpoint(ctx, client, newEndpointRequest(ctx, nil), &sdkv1.RunRequest{}, logger, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, sdkv1.Status_STATUS_OK, res.GetStatus())
+	assert.Equal(t, "HTTP/2.0", protocol)
+}
+
+func TestFreeEndpoint(t *testing.T) {
+	endpoint, err := freeEndpoint()
+	assert.NoError(t, err)
+	assert.NoError(t, validateEndpoint(endpoint))
+
+	l, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
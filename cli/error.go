@@ -1,6 +1,57 @@
 package cli
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes used by the run command for failures of the CLI itself. The
+// run command exits with the exit status of the local application
+// otherwise, or 128+n if it was terminated by signal n. The range is the
+// same as the one used by docker run, and by shells, for similar failures.
+const (
+	// exitCodeError is the exit code of the run command when the CLI fails.
+	exitCodeError = 125
+	// exitCodeCannotExecute is the exit code of the run command when the
+	// local application cannot be executed.
+	exitCodeCannotExecute = 126
+	// exitCodeNotFound is the exit code of the run command when the local
+	// application is not found.
+	exitCodeNotFound = 127
+)
+
+// exitError is an error that results in a specific exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// ExitCode returns the exit code of the CLI for an error returned by Main.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return 1
+}
+
+// runError returns the error of the run command for a failure of the CLI
+// itself, so that it can be told apart from the exit status of the local
+// application.
+func runError(err error) error {
+	var e *exitError
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	return &exitError{code: exitCodeError, err: err}
+}
 
 type authError struct{}
 
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+)
+
+var (
+	OnlyFunctions []string
+	SkipFunctions []string
+	SkipStatus    string
+)
+
+const defaultSkipStatus = "ok"
+
+// validateFunctionPatterns checks that the --only and --skip patterns are
+// valid.
+func validateFunctionPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid function pattern: %q", pattern)
+		}
+	}
+	return nil
+}
+
+// parseStatus parses a status name, e.g. ok or temporary-error.
+func parseStatus(name string) (sdkv1.Status, error) {
+	s := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	if !strings.HasPrefix(s, "STATUS_") {
+		s = "STATUS_" + s
+	}
+	status, ok := sdkv1.Status_value[s]
+	if !ok || status == int32(sdkv1.Status_STATUS_UNSPECIFIED) {
+		return 0, fmt.Errorf("invalid status: %q", name)
+	}
+	return sdkv1.Status(status), nil
+}
+
+// functionSkipped returns true if calls to the function are filtered out by
+// the --only and --skip options.
+func functionSkipped(function string) bool {
+	if len(OnlyFunctions) > 0 && !matchFunction(OnlyFunctions, function) {
+		return true
+	}
+	return matchFunction(SkipFunctions, function)
+}
+
+func matchFunction(patterns []string, function string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, function); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// skippedResponse returns the response to a function call that is not
+// forwarded to the local application, with the specified status.
+func skippedResponse(status sdkv1.Status) *sdkv1.RunResponse {
+	result := &sdkv1.CallResult{}
+	if status != sdkv1.Status_STATUS_OK {
+		result.Error = &sdkv1.Error{
+			Type:    "SkippedError",
+			Message: "function call skipped by dispatch run",
+		}
+	}
+	return &sdkv1.RunResponse{
+		Status: status,
+		Directive: &sdkv1.RunResponse_Exit{
+			Exit: &sdkv1.Exit{Result: result},
+		},
+	}
+}
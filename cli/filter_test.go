@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFunctionSkipped(t *testing.T) {
+	defer func(only, skip []string) {
+		OnlyFunctions, SkipFunctions = only, skip
+	}(OnlyFunctions, SkipFunctions)
+
+	tests := []struct {
+		only     []string
+		skip     []string
+		function string
+		skipped  bool
+	}{
+		{function: "billing.charge", skipped: false},
+		{only: []string{"billing.*"}, function: "billing.charge", skipped: false},
+		{only: []string{"billing.*"}, function: "email.send", skipped: true},
+		{skip: []string{"email.*"}, function: "email.send", skipped: true},
+		{skip: []string{"email.*"}, function: "billing.charge", skipped: false},
+		{only: []string{"billing.*"}, skip: []string{"billing.refund"}, function: "billing.refund", skipped: true},
+		{only: []string{"email.send", "billing.*"}, function: "email.send", skipped: false},
+	}
+	for _, test := range tests {
+		OnlyFunctions, SkipFunctions = test.only, test.skip
+		assert.Equal(t, test.skipped, functionSkipped(test.function), "only=%v skip=%v function=%s", test.only, test.skip, test.function)
+	}
+
+	assert.Error(t, validateFunctionPatterns([]string{"billing.["}))
+	assert.NoError(t, validateFunctionPatterns([]string{"billing.*"}))
+}
+
+func TestParseStatus(t *testing.T) {
+	for name, expected := range map[string]sdkv1.Status{
+		"ok":                 sdkv1.Status_STATUS_OK,
+		"temporary-error":    sdkv1.Status_STATUS_TEMPORARY_ERROR,
+		"PERMANENT_ERROR":    sdkv1.Status_STATUS_PERMANENT_ERROR,
+		"STATUS_THROTTLED":   sdkv1.Status_STATUS_THROTTLED,
+		"incompatible-state": sdkv1.Status_STATUS_INCOMPATIBLE_STATE,
+	} {
+		status, err := parseStatus(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, status)
+	}
+
+	for _, name := range []string{"", "unspecified", "fine"} {
+		_, err := parseStatus(name)
+		assert.Error(t, err)
+	}
+}
+
+func TestCallEndpointSkipped(t *testing.T) {
+	defer func(skip []string, status string) {
+		SkipFunctions, SkipStatus = skip, status
+	}(SkipFunctions, SkipStatus)
+	SkipFunctions, SkipStatus = []string{"email.*"}, "temporary-error"
+
+	// The endpoint is not contacted, so there's no need for a server.
+	req, err := http.NewRequest("POST", "http://127.0.0.1:1/dispatch.sdk.v1.FunctionService/Run", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runRequest := &sdkv1.RunRequest{Function: "email.send"}
+
+	res, runResponse, err := callEndpoint(context.Background(), http.DefaultClient, req, runRequest, slog.Default(), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, sdkv1.Status_STATUS_TEMPORARY_ERROR, runResponse.Status)
+	assert.Equal(t, "SkippedError", runResponse.GetExit().GetResult().GetError().GetType())
+}
@@ -0,0 +1,214 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var HookCommand string
+
+// hookTimeout is the maximum amount of time a hook command can run for.
+const hookTimeout = 10 * time.Second
+
+const (
+	requestHookEvent  = "request"
+	responseHookEvent = "response"
+)
+
+// hookInput is the JSON document written to the stdin of hook commands.
+type hookInput struct {
+	Event    string          `json:"event"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// hookOutput is the JSON document that hook commands may write to their
+// stdout, to modify or annotate function calls.
+type hookOutput struct {
+	Request     json.RawMessage   `json:"request"`
+	Response    json.RawMessage   `json:"response"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// hookResult is the result of running a hook command.
+type hookResult struct {
+	// request and response are the modified request and response, or nil
+	// if they were not modified.
+	request     *sdkv1.RunRequest
+	response    *sdkv1.RunResponse
+	annotations map[string]string
+}
+
+// hookVetoError is returned when a hook command vetoes a function call, by
+// exiting with a non-zero status.
+type hookVetoError struct {
+	reason string
+}
+
+func (e hookVetoError) Error() string {
+	return "Vetoed by hook: " + e.reason
+}
+
+// hookError is returned when a hook command cannot be run, is killed or
+// times out, or writes an invalid output. The function call is responded
+// to with a temporary error, so that it's retried.
+type hookError struct {
+	reason string
+}
+
+func (e hookError) Error() string {
+	return "Hook failed: " + e.reason
+}
+
+// runHook runs the hook command for a request, or for a response if res is
+// not nil. It returns nil if no hook is configured, or if the function call
+// cannot be encoded as JSON, e.g. because it contains values of types
+// unknown to the CLI.
+//
+// The error is a hookVetoError if the hook vetoed the function call, a
+// hookError if the hook failed, or the error of ctx if it was canceled
+// while the hook was running.
+func runHook(ctx context.Context, command string, req *sdkv1.RunRequest, res *sdkv1.RunResponse, logger *slog.Logger) (*hookResult, error) {
+	if command == "" {
+		return nil, nil
+	}
+
+	input := hookInput{Event: requestHookEvent}
+	var err error
+	if input.Request, err = protojson.Marshal(req); err != nil {
+		logger.Warn("cannot pass request to hook", "function", req.Function, "error", err)
+		return nil, nil
+	}
+	if res != nil {
+		input.Event = responseHookEvent
+		if input.Response, err = protojson.Marshal(res); err != nil {
+			logger.Warn("cannot pass response to hook", "function", req.Function, "error", err)
+			return nil, nil
+		}
+	}
+	stdin, err := json.Marshal(input)
+	if err != nil {
+		panic(err)
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(hookCtx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(hookCtx, "sh", "-c", command)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), "DISPATCH_HOOK_EVENT="+input.Event)
+	// Don't wait for processes started by the command, which may hold its
+	// output open, once it has been killed.
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case hookCtx.Err() != nil:
+			return nil, hookError{reason: fmt.Sprintf("timed out after %v", hookTimeout)}
+		case !errors.As(err, &exitErr) || !exitErr.Exited():
+			return nil, hookError{reason: err.Error()}
+		case runtime.GOOS != "windows" && (exitErr.ExitCode() == 126 || exitErr.ExitCode() == 127):
+			// The shell couldn't find or execute the command.
+			return nil, hookError{reason: strings.TrimSpace(stderr.String())}
+		}
+		reason := strings.TrimSpace(stderr.String())
+		if reason == "" {
+			reason = err.Error()
+		}
+		return nil, hookVetoError{reason: reason}
+	}
+
+	result := &hookResult{}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return result, nil
+	}
+	var output hookOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return nil, hookError{reason: fmt.Sprintf("invalid output: %v", err)}
+	}
+	result.annotations = output.Annotations
+
+	if len(output.Request) > 0 && res == nil {
+		result.request = &sdkv1.RunRequest{}
+		if err := protojson.Unmarshal(output.Request, result.request); err != nil {
+			return nil, hookError{reason: fmt.Sprintf("invalid request in output: %v", err)}
+		}
+		// The function call cannot be changed for another one.
+		result.request.DispatchId = req.DispatchId
+		result.request.ParentDispatchId = req.ParentDispatchId
+		result.request.RootDispatchId = req.RootDispatchId
+	}
+	if len(output.Response) > 0 && res != nil {
+		result.response = &sdkv1.RunResponse{}
+		if err := protojson.Unmarshal(output.Response, result.response); err != nil {
+			return nil, hookError{reason: fmt.Sprintf("invalid response in output: %v", err)}
+		}
+	}
+	return result, nil
+}
+
+// hookErrorResponse returns the response to a function call that a hook
+// vetoed, or failed on. It returns nil if err isn't a hookVetoError or a
+// hookError.
+func hookErrorResponse(err error) *sdkv1.RunResponse {
+	var status sdkv1.Status
+	var reason string
+	var vetoed hookVetoError
+	var failed hookError
+	switch {
+	case errors.As(err, &vetoed):
+		status, reason = sdkv1.Status_STATUS_PERMANENT_ERROR, vetoed.reason
+	case errors.As(err, &failed):
+		status, reason = sdkv1.Status_STATUS_TEMPORARY_ERROR, failed.reason
+	default:
+		return nil
+	}
+	return &sdkv1.RunResponse{
+		Status: status,
+		Directive: &sdkv1.RunResponse_Exit{
+			Exit: &sdkv1.Exit{
+				Result: &sdkv1.CallResult{
+					Error: &sdkv1.Error{
+						Type:    "HookError",
+						Message: reason,
+					},
+				},
+			},
+		},
+	}
+}
+
+// logAnnotations logs the annotations of a function call by a hook.
+func logAnnotations(logger *slog.Logger, req *sdkv1.RunRequest, result *hookResult) {
+	if result == nil || len(result.annotations) == 0 {
+		return
+	}
+	args := []any{"function", req.Function}
+	for k, v := range result.annotations {
+		args = append(args, k, v)
+	}
+	logger.Info("function call annotated by hook", args...)
+}
@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestRunHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with sh")
+	}
+	ctx := context.Background()
+	logger := slog.New(&slogHandler{stream: io.Discard})
+
+	input, err := anypb.New(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &sdkv1.RunRequest{Function: "work", DispatchId: "1", Directive: &sdkv1.RunRequest_Input{Input: input}}
+	res := &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK}
+
+	t.Run("no hook", func(t *testing.T) {
+		result, err := runHook(ctx, "", req, nil, logger)
+		assert.NoError(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("input", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "input.json")
+		_, err := runHook(ctx, "cat > "+path, req, res, logger)
+		assert.NoError(t, err)
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var input struct {
+			Event    string         `json:"event"`
+			Request  map[string]any `json:"request"`
+			Response map[string]any `json:"response"`
+		}
+		if err := json.Unmarshal(b, &input); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "response", input.Event)
+		assert.Equal(t, "work", input.Request["function"])
+		assert.Equal(t, "STATUS_OK", input.Response["status"])
+	})
+
+	t.Run("veto", func(t *testing.T) {
+		_, err := runHook(ctx, "echo 'forbidden function' >&2; exit 1", req, nil, logger)
+		assert.Equal(t, hookVetoError{reason: "forbidden function"}, err)
+		assert.Equal(t, sdkv1.Status_STATUS_PERMANENT_ERROR, hookErrorResponse(err).Status)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		for _, command := range []string{
+			"echo 'not json'",
+			"kill -9 $$",
+			"dispatch-hook-that-does-not-exist",
+		} {
+			_, err := runHook(ctx, command, req, nil, logger)
+			assert.ErrorAs(t, err, &hookError{}, command)
+			assert.Equal(t, sdkv1.Status_STATUS_TEMPORARY_ERROR, hookErrorResponse(err).Status, command)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		_, err := runHook(ctx, "sleep 5", req, nil, logger)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Nil(t, hookErrorResponse(err))
+	})
+
+	t.Run("modify", func(t *testing.T) {
+		result, err := runHook(ctx, `echo '{"request": {"function": "other", "dispatchId": "2"}, "annotations": {"schema": "v2"}}'`, req, nil, logger)
+		assert.NoError(t, err)
+		assert.Equal(t, "other", result.request.Function)
+		assert.Equal(t, "1", result.request.DispatchId)
+		assert.Equal(t, map[string]string{"schema": "v2"}, result.annotations)
+
+		result, err = runHook(ctx, `echo '{"response": {"status": "STATUS_TEMPORARY_ERROR"}}'`, req, res, logger)
+		assert.NoError(t, err)
+		assert.Equal(t, sdkv1.Status_STATUS_TEMPORARY_ERROR, result.response.Status)
+	})
+}
+
+func TestCallEndpointHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with sh")
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/proto")
+		body, _ := proto.Marshal(&sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK})
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	oldEndpoint, oldHook := LocalEndpoint, HookCommand
+	LocalEndpoint = server.Listener.Addr().String()
+	defer func() { LocalEndpoint, HookCommand = oldEndpoint, oldHook }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	logger := slog.New(&slogHandler{stream: io.Discard})
+
+	call := func() *sdkv1.RunResponse {
+		req := &sdkv1.RunRequest{Function: "work", DispatchId: "1"}
+		body, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, res, err := callEndpoint(ctx, http.DefaultClient, newEndpointRequest(ctx, body), req, logger, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	HookCommand = "true"
+	assert.Equal(t, sdkv1.Status_STATUS_OK, call().Status)
+
+	// Requests are vetoed before they're forwarded.
+	HookCommand = `grep -q '"event":"request"' && echo 'no work today' >&2 && exit 1; true`
+	res := call()
+	assert.Equal(t, sdkv1.Status_STATUS_PERMANENT_ERROR, res.Status)
+	assert.Equal(t, "HookError", res.GetExit().GetResult().GetError().GetType())
+	assert.Equal(t, "no work today", res.GetExit().GetResult().GetError().GetMessage())
+
+	// Calls are retried if the hook fails.
+	HookCommand = `grep -q '"event":"request"' && kill -9 $$; true`
+	assert.Equal(t, sdkv1.Status_STATUS_TEMPORARY_ERROR, call().Status)
+
+	// Responses are replaced after they're received.
+	HookCommand = `grep -q '"event":"response"' && echo '{"response": {"status": "STATUS_THROTTLED"}}'; true`
+	assert.Equal(t, sdkv1.Status_STATUS_THROTTLED, call().Status)
+}
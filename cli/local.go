@@ -0,0 +1,509 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// localApiKey is the API key exported to the local application when
+	// running in local mode. The local scheduler does not authenticate
+	// requests, but the SDKs refuse to start without an API key.
+	localApiKey = "local"
+
+	runPath      = "/dispatch.sdk.v1.FunctionService/Run"
+	dispatchPath = "/dispatch.sdk.v1.DispatchService/Dispatch"
+
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 10 * time.Second
+)
+
+// localScheduler is an in-process replacement for the Dispatch bridge.
+//
+// Instead of polling Dispatch for work, the scheduler accepts calls from
+// the local application via a minimal implementation of the Dispatch API,
+// and drives the function calls itself: it builds RunRequests, forwards them
+// to the local application endpoint, retries calls that fail with a
+// non-terminal status, follows tail calls, and resumes coroutines once the
+// results of the calls they're waiting for are available.
+type localScheduler struct {
+	client   *http.Client
+	observer FunctionCallObserver
+	limiter  *concurrencyLimiter
+	// ready holds function calls while the local application is not
+	// ready to accept them. Calls are sent right away if it's nil.
+	ready *readyGate
+	// breakpoints holds function calls paused at a breakpoint, if not nil.
+	breakpoints *breakpoints
+
+	ctx context.Context
+	wg  sync.WaitGroup
+	// dispatchCtx is canceled once the scheduler stops sending new
+	// requests to the local application, e.g. while in-flight calls are
+	// drained on shutdown.
+	dispatchCtx  context.Context
+	stopDispatch context.CancelFunc
+
+	mu    sync.Mutex
+	calls map[DispatchID]*localCall
+
+	requests int64
+}
+
+// localCall is the scheduler state associated with a function call.
+type localCall struct {
+	id            DispatchID
+	parentID      DispatchID
+	rootID        DispatchID
+	correlationID uint64
+	function      string
+	input         *anypb.Any
+
+	creationTime   time.Time
+	expirationTime time.Time
+
+	// Number of consecutive failed attempts, used to compute retry delays.
+	failures int
+
+	// Set when the parent coroutine was restarted, in which case the result
+	// of the call is discarded.
+	detached bool
+
+	// The following fields are set while the call is suspended.
+	poll    *sdkv1.Poll
+	pending int
+	results []*sdkv1.CallResult
+	timer   *time.Timer
+}
+
+func newLocalScheduler(ctx context.Context, client *http.Client, observer FunctionCallObserver, limiter *concurrencyLimiter, ready *readyGate, bp *breakpoints) *localScheduler {
+	dispatchCtx, stopDispatch := context.WithCancel(ctx)
+	return &localScheduler{
+		client:       client,
+		observer:     observer,
+		limiter:      limiter,
+		ready:        ready,
+		breakpoints:  bp,
+		ctx:          ctx,
+		dispatchCtx:  dispatchCtx,
+		stopDispatch: stopDispatch,
+		calls:        map[DispatchID]*localCall{},
+	}
+}
+
+// serve accepts calls from the local application on the listener and drives
+// them until the context is canceled. It returns once the in-flight calls
+// have returned.
+func (s *localScheduler) serve(l net.Listener) {
+	server := &http.Server{Handler: s}
+	go func() {
+		<-s.ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("local scheduler failed", "error", err)
+	}
+
+	s.mu.Lock()
+	for _, c := range s.calls {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// stopDispatching stops sending new requests to the local application,
+// so that the in-flight calls can be drained. Retries, resumes, and calls
+// made by the in-flight calls are dropped, as well as the requests waiting
+// for their turn.
+func (s *localScheduler) stopDispatching() {
+	s.stopDispatch()
+}
+
+// requestCount returns the number of RunRequests sent to the local
+// application so far.
+func (s *localScheduler) requestCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// ServeHTTP implements the subset of the Dispatch API that the SDKs use
+// to dispatch function calls.
+func (s *localScheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != dispatchPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+
+	var req sdkv1.DispatchRequest
+	switch contentType {
+	case "application/proto":
+		err = proto.Unmarshal(body, &req)
+	case "application/json":
+		err = protojson.Unmarshal(body, &req)
+	default:
+		http.Error(w, "unsupported content type: "+contentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		http.Error(w, "scheduler is not running", http.StatusServiceUnavailable)
+		return
+	}
+	res := &sdkv1.DispatchResponse{}
+	for _, call := range req.Calls {
+		res.DispatchIds = append(res.DispatchIds, string(s.dispatch(nil, call)))
+	}
+	s.mu.Unlock()
+
+	var b []byte
+	switch contentType {
+	case "application/proto":
+		b, err = proto.Marshal(res)
+	default:
+		b, err = protojson.Marshal(res)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(b)
+}
+
+// dispatch creates a function call and schedules its first RunRequest.
+//
+// The caller must hold s.mu.
+func (s *localScheduler) dispatch(parent *localCall, call *sdkv1.Call) DispatchID {
+	now := time.Now()
+
+	c := &localCall{
+		id:            DispatchID(randomSessionID()),
+		correlationID: call.CorrelationId,
+		function:      call.Function,
+		input:         call.Input,
+		creationTime:  now,
+	}
+	if parent != nil {
+		c.parentID = parent.id
+		c.rootID = parent.rootID
+	} else {
+		c.rootID = c.id
+	}
+	if call.Expiration != nil {
+		c.expirationTime = now.Add(call.Expiration.AsDuration())
+	}
+	s.calls[c.id] = c
+
+	s.start(c)
+	return c.id
+}
+
+// start schedules a RunRequest that starts the function call from scratch.
+//
+// The caller must hold s.mu.
+func (s *localScheduler) start(c *localCall) {
+	s.schedule(c, newStartRequest(c), 0)
+}
+
+// newStartRequest creates a RunRequest that starts the function call from
+// scratch.
+func newStartRequest(c *localCall) *sdkv1.RunRequest {
+	req := newLocalRequest(c)
+	req.Directive = &sdkv1.RunRequest_Input{Input: c.input}
+	return req
+}
+
+func newLocalRequest(c *localCall) *sdkv1.RunRequest {
+	req := &sdkv1.RunRequest{
+		Function:         c.function,
+		DispatchId:       string(c.id),
+		ParentDispatchId: string(c.parentID),
+		RootDispatchId:   string(c.rootID),
+		CreationTime:     timestamppb.New(c.creationTime),
+	}
+	if !c.expirationTime.IsZero() {
+		req.ExpirationTime = timestamppb.New(c.expirationTime)
+	}
+	return req
+}
+
+// schedule sends the RunRequest to the local application after the
+// specified delay.
+//
+// The caller must hold s.mu.
+func (s *localScheduler) schedule(c *localCall, req *sdkv1.RunRequest, delay time.Duration) {
+	ctx := s.dispatchCtx
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+
+		if s.ready != nil && !s.ready.wait(ctx) {
+			return
+		}
+
+		if !s.limiter.acquire(ctx) {
+			return
+		}
+		defer s.limiter.release()
+
+		// Requests that were sent are allowed to complete once the
+		// scheduler stops dispatching.
+		s.call(s.ctx, c, req)
+	}()
+}
+
+func (s *localScheduler) call(ctx context.Context, c *localCall, req *sdkv1.RunRequest) {
+	logger := slog.Default()
+	if Verbose {
+		logger = slog.With("dispatch_id", req.DispatchId)
+	}
+
+	logger.Debug("sending request to local application", "endpoint", LocalEndpoint)
+
+	body, err := proto.Marshal(req)
+	if err != nil {
+		panic(err)
+	}
+	endpointReq := newEndpointRequest(ctx, body)
+
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+
+	endpointRes, res, err := callEndpoint(ctx, s.client, endpointReq, req, logger, s.observer, s.breakpoints)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		logger.Warn(err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case res != nil:
+		s.handleResponse(c, req, res)
+	case errors.As(err, &expiredError{}):
+		s.complete(c, &sdkv1.CallResult{
+			Error: &sdkv1.Error{
+				Type:    "TimeoutError",
+				Message: "function call expired",
+			},
+		})
+	case endpointRes != nil && terminalHTTPStatusCode(endpointRes.StatusCode):
+		s.complete(c, &sdkv1.CallResult{
+			Error: &sdkv1.Error{
+				Type:    "HTTPError",
+				Message: fmt.Sprintf("%d %s", endpointRes.StatusCode, http.StatusText(endpointRes.StatusCode)),
+			},
+		})
+	default:
+		s.retry(c, req)
+	}
+}
+
+// handleResponse advances the state of a function call after a RunResponse
+// has been received from the local application.
+//
+// The caller must hold s.mu.
+func (s *localScheduler) handleResponse(c *localCall, req *sdkv1.RunRequest, res *sdkv1.RunResponse) {
+	switch {
+	case res.Status == sdkv1.Status_STATUS_INCOMPATIBLE_STATE:
+		// The coroutine state cannot be resumed by the local application,
+		// e.g. because the code changed. Restart the call from scratch,
+		// discarding the results of the calls made by the previous run.
+		c.results = nil
+		c.pending = 0
+		for _, child := range s.calls {
+			if child.parentID == c.id {
+				child.detached = true
+			}
+		}
+		s.retry(c, newStartRequest(c))
+		return
+	case !terminalStatus(res.Status):
+		s.retry(c, req)
+		return
+	}
+	c.failures = 0
+
+	switch d := res.Directive.(type) {
+	case *sdkv1.RunResponse_Exit:
+		if tailCall := d.Exit.TailCall; tailCall != nil && res.Status == sdkv1.Status_STATUS_OK {
+			c.function = tailCall.Function
+			c.input = tailCall.Input
+			s.start(c)
+			return
+		}
+		// The result is passed on to the parent coroutine, which updates
+		// it. Copy it, since the response may be shared, e.g. if it's the
+		// canned response of a mocked function.
+		result := &sdkv1.CallResult{}
+		if d.Exit.Result != nil {
+			result = proto.Clone(d.Exit.Result).(*sdkv1.CallResult)
+		}
+		if res.Status != sdkv1.Status_STATUS_OK && result.Error == nil {
+			result.Error = &sdkv1.Error{Type: statusString(res.Status)}
+		}
+		s.complete(c, result)
+
+	case *sdkv1.RunResponse_Poll:
+		if res.Status != sdkv1.Status_STATUS_OK {
+			s.complete(c, &sdkv1.CallResult{Error: &sdkv1.Error{Type: statusString(res.Status)}})
+			return
+		}
+		c.poll = d.Poll
+		for _, call := range d.Poll.Calls {
+			s.dispatch(c, call)
+			c.pending++
+		}
+		if maxWait := d.Poll.MaxWait; maxWait != nil {
+			c.timer = time.AfterFunc(maxWait.AsDuration(), func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if c.poll != nil && s.ctx.Err() == nil {
+					s.resume(c)
+				}
+			})
+		}
+		s.maybeResume(c)
+
+	default:
+		s.complete(c, &sdkv1.CallResult{Error: &sdkv1.Error{Type: "InvalidResponse", Message: "missing directive"}})
+	}
+}
+
+// retry schedules another attempt of the RunRequest.
+//
+// The caller must hold s.mu.
+func (s *localScheduler) retry(c *localCall, req *sdkv1.RunRequest) {
+	c.failures++
+	s.schedule(c, req, retryDelay(c.failures))
+}
+
+// complete records the result of a function call and passes it on to the
+// parent coroutine, if any.
+//
+// The caller must hold s.mu.
+func (s *localScheduler) complete(c *localCall, result *sdkv1.CallResult) {
+	delete(s.calls, c.id)
+
+	parent, ok := s.calls[c.parentID]
+	if !ok || c.detached {
+		return
+	}
+	result.CorrelationId = c.correlationID
+	result.DispatchId = string(c.id)
+	parent.results = append(parent.results, result)
+	parent.pending--
+	s.maybeResume(parent)
+}
+
+// maybeResume resumes a suspended coroutine if enough results are available.
+//
+// The caller must hold s.mu.
+func (s *localScheduler) maybeResume(c *localCall) {
+	if c.poll == nil {
+		return
+	}
+	minResults := max(int(c.poll.MinResults), 1)
+	if len(c.results) >= minResults || c.pending <= 0 {
+		s.resume(c)
+	}
+}
+
+// resume sends a RunRequest with the results that are available to a
+// suspended coroutine.
+//
+// The caller must hold s.mu.
+func (s *localScheduler) resume(c *localCall) {
+	poll := c.poll
+	c.poll = nil
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	results := c.results
+	if maxResults := int(poll.MaxResults); maxResults > 0 && len(results) > maxResults {
+		results, c.results = results[:maxResults:maxResults], results[maxResults:]
+	} else {
+		c.results = nil
+	}
+
+	pollResult := &sdkv1.PollResult{Results: results}
+	switch state := poll.State.(type) {
+	case *sdkv1.Poll_CoroutineState:
+		pollResult.State = &sdkv1.PollResult_CoroutineState{CoroutineState: state.CoroutineState}
+	case *sdkv1.Poll_TypedCoroutineState:
+		pollResult.State = &sdkv1.PollResult_TypedCoroutineState{TypedCoroutineState: state.TypedCoroutineState}
+	}
+
+	req := newLocalRequest(c)
+	req.Directive = &sdkv1.RunRequest_PollResult{PollResult: pollResult}
+	s.schedule(c, req, 0)
+}
+
+// newEndpointRequest creates an HTTP request that sends a serialized
+// RunRequest to the local application endpoint.
+func newEndpointRequest(ctx context.Context, body []byte) *http.Request {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpointRequestURL(runPath), bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/proto")
+	return req
+}
+
+func retryDelay(failures int) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
@@ -0,0 +1,290 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestLocalScheduler(t *testing.T) {
+	var childAttempts int64
+	done := make(chan *sdkv1.PollResult, 1)
+
+	// The local application polls two child calls from the root function.
+	// The first attempt of each child fails with a temporary error.
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, runPath, r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+
+		var res *sdkv1.RunResponse
+		switch req.Function {
+		case "root":
+			switch d := req.Directive.(type) {
+			case *sdkv1.RunRequest_Input:
+				res = &sdkv1.RunResponse{
+					Status: sdkv1.Status_STATUS_OK,
+					Directive: &sdkv1.RunResponse_Poll{Poll: &sdkv1.Poll{
+						State:      &sdkv1.Poll_CoroutineState{CoroutineState: []byte("state")},
+						Calls:      []*sdkv1.Call{{CorrelationId: 1, Function: "child"}, {CorrelationId: 2, Function: "child"}},
+						MinResults: 2,
+					}},
+				}
+			case *sdkv1.RunRequest_PollResult:
+				done <- d.PollResult
+				res = &sdkv1.RunResponse{
+					Status:    sdkv1.Status_STATUS_OK,
+					Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{Result: &sdkv1.CallResult{}}},
+				}
+			}
+		case "child":
+			if atomic.AddInt64(&childAttempts, 1) <= 2 {
+				res = &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_TEMPORARY_ERROR}
+			} else {
+				output, _ := anypb.New(wrapperspb.String("ok"))
+				res = &sdkv1.RunResponse{
+					Status:    sdkv1.Status_STATUS_OK,
+					Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{Result: &sdkv1.CallResult{Output: output}}},
+				}
+			}
+		}
+
+		b, _ := proto.Marshal(res)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	}))
+	defer app.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dispatchLocal(ctx, t, app, "root")
+
+	select {
+	case pollResult := <-done:
+		assert.Equal(t, []byte("state"), pollResult.GetCoroutineState())
+		assert.Len(t, pollResult.Results, 2)
+		correlationIDs := map[uint64]bool{}
+		for _, result := range pollResult.Results {
+			correlationIDs[result.CorrelationId] = true
+			assert.Equal(t, `"ok"`, anyString(result.Output))
+		}
+		assert.Equal(t, map[uint64]bool{1: true, 2: true}, correlationIDs)
+	case <-ctx.Done():
+		t.Fatal("root function was not resumed")
+	}
+	assert.Equal(t, int64(4), atomic.LoadInt64(&childAttempts))
+}
+
+func TestLocalSchedulerIncompatibleState(t *testing.T) {
+	var rootStarts int64
+	var incompatibleTime atomic.Value
+	done := make(chan *sdkv1.PollResult, 1)
+
+	// The first coroutine state of the root function cannot be resumed,
+	// so the call is restarted from scratch. The first run polls two child
+	// calls and is resumed after the first one returned; the second run
+	// polls another child call.
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+
+		res := &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK, Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{}}}
+		if req.Function == "root" {
+			switch d := req.Directive.(type) {
+			case *sdkv1.RunRequest_Input:
+				calls := []*sdkv1.Call{{CorrelationId: 1, Function: "child"}, {CorrelationId: 2, Function: "child"}}
+				if atomic.AddInt64(&rootStarts, 1) == 2 {
+					assert.GreaterOrEqual(t, time.Since(incompatibleTime.Load().(time.Time)), minRetryDelay)
+					calls = []*sdkv1.Call{{CorrelationId: 3, Function: "child"}}
+				}
+				res.Directive = &sdkv1.RunResponse_Poll{Poll: &sdkv1.Poll{Calls: calls, MinResults: 1}}
+			case *sdkv1.RunRequest_PollResult:
+				if atomic.LoadInt64(&rootStarts) == 1 {
+					incompatibleTime.Store(time.Now())
+					res = &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_INCOMPATIBLE_STATE}
+				} else {
+					done <- d.PollResult
+				}
+			}
+		}
+		b, _ := proto.Marshal(res)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	}))
+	defer app.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dispatchLocal(ctx, t, app, "root")
+
+	select {
+	case pollResult := <-done:
+		// The results of the child calls made by the first run are dropped.
+		if assert.Len(t, pollResult.Results, 1) {
+			assert.Equal(t, uint64(3), pollResult.Results[0].CorrelationId)
+		}
+	case <-ctx.Done():
+		t.Fatal("root function was not restarted")
+	}
+	assert.Equal(t, int64(2), atomic.LoadInt64(&rootStarts))
+}
+
+func TestLocalSchedulerMocks(t *testing.T) {
+	done := make(chan *sdkv1.PollResult, 1)
+
+	// The root function polls two calls to a mocked function, which are
+	// never forwarded to the local application.
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "root", req.Function)
+
+		res := &sdkv1.RunResponse{
+			Status: sdkv1.Status_STATUS_OK,
+			Directive: &sdkv1.RunResponse_Poll{Poll: &sdkv1.Poll{
+				Calls:      []*sdkv1.Call{{CorrelationId: 1, Function: "child"}, {CorrelationId: 2, Function: "child"}},
+				MinResults: 2,
+			}},
+		}
+		if d, ok := req.Directive.(*sdkv1.RunRequest_PollResult); ok {
+			done <- d.PollResult
+			res = &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK, Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{}}}
+		}
+		b, _ := proto.Marshal(res)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	}))
+	defer app.Close()
+
+	oldMocks := functionMocks
+	defer func() { functionMocks = oldMocks }()
+	mock, err := (&functionMock{Output: "mocked"}).runResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	functionMocks = map[string]*sdkv1.RunResponse{"child": mock}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dispatchLocal(ctx, t, app, "root")
+
+	select {
+	case pollResult := <-done:
+		if !assert.Len(t, pollResult.Results, 2) {
+			return
+		}
+		r1, r2 := pollResult.Results[0], pollResult.Results[1]
+		assert.ElementsMatch(t, []uint64{1, 2}, []uint64{r1.CorrelationId, r2.CorrelationId})
+		assert.NotEqual(t, r1.DispatchId, r2.DispatchId)
+		assert.Equal(t, `"mocked"`, anyString(r1.Output))
+		assert.Equal(t, `"mocked"`, anyString(r2.Output))
+	case <-ctx.Done():
+		t.Fatal("root function was not resumed")
+	}
+
+	// The canned response is left untouched.
+	assert.Zero(t, mock.GetExit().GetResult().GetCorrelationId())
+	assert.Empty(t, mock.GetExit().GetResult().GetDispatchId())
+}
+
+func TestLocalSchedulerStopDispatching(t *testing.T) {
+	var childCalls int64
+	release := make(chan struct{})
+
+	// The root function polls a child call once it's released.
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+
+		res := &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK, Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{}}}
+		if req.Function == "child" {
+			atomic.AddInt64(&childCalls, 1)
+		} else {
+			<-release
+			res.Directive = &sdkv1.RunResponse_Poll{Poll: &sdkv1.Poll{
+				Calls:      []*sdkv1.Call{{CorrelationId: 1, Function: "child"}},
+				MinResults: 1,
+			}}
+		}
+		b, _ := proto.Marshal(res)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	}))
+	defer app.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	scheduler := dispatchLocal(ctx, t, app, "root")
+
+	assert.Eventually(t, func() bool {
+		inflight, _ := scheduler.limiter.counts()
+		return inflight == 1
+	}, time.Second, time.Millisecond)
+
+	// The in-flight call completes, but the call it makes is not sent.
+	scheduler.stopDispatching()
+	close(release)
+	assert.Equal(t, 0, scheduler.limiter.drain(ctx, 5*time.Second, nil))
+	assert.Never(t, func() bool { return atomic.LoadInt64(&childCalls) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+// dispatchLocal starts a local scheduler forwarding calls to the app, and
+// dispatches a call to the function.
+func dispatchLocal(ctx context.Context, t *testing.T, app *httptest.Server, function string) *localScheduler {
+	oldEndpoint := LocalEndpoint
+	LocalEndpoint = app.Listener.Addr().String()
+	t.Cleanup(func() { LocalEndpoint = oldEndpoint })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The scheduler is stopped before the endpoint is restored.
+	ctx, cancel := context.WithCancel(ctx)
+	served := make(chan struct{})
+	t.Cleanup(func() { cancel(); <-served })
+
+	scheduler := newLocalScheduler(ctx, http.DefaultClient, nil, newConcurrencyLimiter(1), nil, nil)
+	go func() {
+		defer close(served)
+		scheduler.serve(l)
+	}()
+
+	b, _ := proto.Marshal(&sdkv1.DispatchRequest{Calls: []*sdkv1.Call{{Function: function}}})
+	res, err := http.Post("http://"+l.Addr().String()+dispatchPath, "application/proto", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	var dispatchRes sdkv1.DispatchResponse
+	if err := proto.Unmarshal(b, &dispatchRes); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, dispatchRes.DispatchIds, 1)
+	return scheduler
+}
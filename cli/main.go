@@ -47,6 +47,7 @@ func createMainCommand() *cobra.Command {
 	cmd.AddCommand(switchCommand(DispatchConfigPath))
 	cmd.AddCommand(verificationCommand())
 	cmd.AddCommand(runCommand())
+	cmd.AddCommand(replayCommand())
 	cmd.AddCommand(versionCommand())
 
 	return cmd
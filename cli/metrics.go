@@ -0,0 +1,217 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var MetricsAddr string
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// function call latency histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// sessionMetrics is a FunctionCallObserver that aggregates the requests and
+// responses it observes into metrics, which are served in the Prometheus
+// text format.
+type sessionMetrics struct {
+	mu sync.Mutex
+	// inFlight holds the time each request was sent at, until its response
+	// is observed and the latency of the call can be measured.
+	inFlight      map[*sdkv1.RunRequest]time.Time
+	attempts      map[string]int64
+	calls         map[callOutcome]int64
+	latency       map[string]*histogram
+	pollErrors    map[pollErrorKind]int64
+	requestBytes  int64
+	responseBytes int64
+}
+
+type callOutcome struct {
+	function string
+	status   string
+}
+
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newSessionMetrics() *sessionMetrics {
+	return &sessionMetrics{
+		inFlight:   map[*sdkv1.RunRequest]time.Time{},
+		attempts:   map[string]int64{},
+		calls:      map[callOutcome]int64{},
+		latency:    map[string]*histogram{},
+		pollErrors: map[pollErrorKind]int64{},
+	}
+}
+
+func (m *sessionMetrics) ObserveRequest(now time.Time, req *sdkv1.RunRequest) {
+	size := int64(proto.Size(req))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight[req] = now
+	m.attempts[req.Function]++
+	m.requestBytes += size
+}
+
+func (m *sessionMetrics) ObserveResponse(now time.Time, req *sdkv1.RunRequest, err error, httpRes *http.Response, res *sdkv1.RunResponse) {
+	var size int64
+	var status string
+	switch {
+	case res != nil:
+		size = int64(proto.Size(res))
+		status = strings.ToLower(strings.TrimPrefix(res.Status.String(), "STATUS_"))
+	case httpRes != nil && err == nil:
+		size = max(httpRes.ContentLength, 0)
+		status = "invalid_response"
+	default:
+		status = "error"
+	}
+	// Responses generated by the CLI, e.g. for mocked or skipped functions,
+	// don't tell anything about the latency of the local application.
+	synthetic := isSynthetic(err, httpRes)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start, ok := m.inFlight[req]
+	if !ok {
+		return
+	}
+	delete(m.inFlight, req)
+
+	m.calls[callOutcome{function: req.Function, status: status}]++
+	m.responseBytes += size
+
+	if synthetic {
+		return
+	}
+	h := m.latency[req.Function]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latency[req.Function] = h
+	}
+	h.observe(now.Sub(start).Seconds())
+}
+
+// observePollError counts an error that occurred while polling Dispatch
+// for function calls. It's a no-op if m is nil.
+func (m *sessionMetrics) observePollError(err error) {
+	if m == nil {
+		return
+	}
+	kind := classifyPollError(err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pollErrors[kind]++
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *sessionMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.write(w)
+}
+
+// write writes the metrics in the Prometheus text exposition format.
+func (m *sessionMetrics) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := bufio.NewWriter(w)
+
+	header(b, "dispatch_function_call_attempts_total", "counter", "Function call requests forwarded to the local application.")
+	for _, function := range sortedKeys(m.attempts) {
+		sample(b, "dispatch_function_call_attempts_total", m.attempts[function], "function", function)
+	}
+
+	header(b, "dispatch_function_calls_total", "counter", "Function call responses, by status.")
+	outcomes := sortedKeys(m.calls)
+	for _, o := range outcomes {
+		sample(b, "dispatch_function_calls_total", m.calls[o], "function", o.function, "status", o.status)
+	}
+
+	header(b, "dispatch_function_call_duration_seconds", "histogram", "Time taken by the local application to respond to function calls.")
+	for _, function := range sortedKeys(m.latency) {
+		h := m.latency[function]
+		for i, le := range latencyBuckets {
+			sample(b, "dispatch_function_call_duration_seconds_bucket", h.counts[i], "function", function, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		sample(b, "dispatch_function_call_duration_seconds_bucket", h.count, "function", function, "le", "+Inf")
+		sample(b, "dispatch_function_call_duration_seconds_sum", h.sum, "function", function)
+		sample(b, "dispatch_function_call_duration_seconds_count", h.count, "function", function)
+	}
+
+	header(b, "dispatch_function_calls_in_flight", "gauge", "Function calls waiting for a response from the local application.")
+	sample(b, "dispatch_function_calls_in_flight", len(m.inFlight))
+
+	header(b, "dispatch_forwarded_bytes_total", "counter", "Bytes of function call requests and responses forwarded.")
+	sample(b, "dispatch_forwarded_bytes_total", m.requestBytes, "direction", "request")
+	sample(b, "dispatch_forwarded_bytes_total", m.responseBytes, "direction", "response")
+
+	header(b, "dispatch_poll_errors_total", "counter", "Errors polling Dispatch for function calls, by kind.")
+	for _, kind := range sortedKeys(m.pollErrors) {
+		sample(b, "dispatch_poll_errors_total", m.pollErrors[kind], "kind", kind.String())
+	}
+
+	return b.Flush()
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of a metric, with labels passed as name/value
+// pairs.
+func sample(w io.Writer, name string, value any, labels ...string) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], labelValueReplacer.Replace(labels[i+1]))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %v\n", value)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[K comparable, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b K) int {
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	})
+	return keys
+}
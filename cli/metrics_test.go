@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionMetrics(t *testing.T) {
+	m := newSessionMetrics()
+	now := time.Now()
+
+	ok := &sdkv1.RunRequest{Function: "work", DispatchId: "1"}
+	m.ObserveRequest(now, ok)
+	m.ObserveResponse(now.Add(200*time.Millisecond), ok, nil, nil, &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK})
+
+	failed := &sdkv1.RunRequest{Function: "work", DispatchId: "2"}
+	m.ObserveRequest(now, failed)
+	m.ObserveResponse(now.Add(2*time.Second), failed, errors.New("connection refused"), nil, nil)
+
+	mocked := &sdkv1.RunRequest{Function: "work", DispatchId: "4"}
+	m.ObserveRequest(now, mocked)
+	mockedResponse := &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK}
+	m.ObserveResponse(now, mocked, nil, syntheticRunResponse(mockedResponse), mockedResponse)
+
+	pending := &sdkv1.RunRequest{Function: `say "hi"`, DispatchId: "3"}
+	m.ObserveRequest(now, pending)
+
+	m.observePollError(authError{})
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", res.Header.Get("Content-Type"))
+
+	var b strings.Builder
+	if err := m.write(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE dispatch_function_calls_total counter",
+		`dispatch_function_call_attempts_total{function="work"} 3`,
+		`dispatch_function_call_attempts_total{function="say \"hi\""} 1`,
+		`dispatch_function_calls_total{function="work",status="ok"} 2`,
+		`dispatch_function_calls_total{function="work",status="error"} 1`,
+		`dispatch_function_call_duration_seconds_bucket{function="work",le="0.25"} 1`,
+		`dispatch_function_call_duration_seconds_bucket{function="work",le="2.5"} 2`,
+		`dispatch_function_call_duration_seconds_bucket{function="work",le="+Inf"} 2`,
+		`dispatch_function_call_duration_seconds_count{function="work"} 2`,
+		`dispatch_function_calls_in_flight 1`,
+		`dispatch_poll_errors_total{kind="auth"} 1`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+
+	var nilMetrics *sessionMetrics
+	nilMetrics.observePollError(authError{})
+}
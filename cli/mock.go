@@ -0,0 +1,203 @@
+package cli
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/pelletier/go-toml/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var MockPath string
+
+// functionMocks are the canned responses of the functions stubbed with the
+// --mock option, indexed by function name.
+var functionMocks map[string]*sdkv1.RunResponse
+
+// functionMock is the canned response of a function in a mock file.
+type functionMock struct {
+	Output any                `json:"output" toml:"output"`
+	Error  *functionMockError `json:"error" toml:"error"`
+	Status string             `json:"status" toml:"status"`
+}
+
+type functionMockError struct {
+	Type    string `json:"type" toml:"type"`
+	Message string `json:"message" toml:"message"`
+}
+
+// loadMocks reads the canned responses of functions from a TOML or JSON
+// file, which maps function names to their output or error.
+func loadMocks(path string) (map[string]*sdkv1.RunResponse, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mock file: %v", err)
+	}
+	defer f.Close()
+
+	mocks, err := decodeMocks(f, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mock file %s: %v", path, err)
+	}
+
+	responses := make(map[string]*sdkv1.RunResponse, len(mocks))
+	for function, mock := range mocks {
+		res, err := mock.runResponse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid mock for function %s: %v", function, err)
+		}
+		responses[function] = res
+	}
+	return responses, nil
+}
+
+func decodeMocks(r io.Reader, ext string) (map[string]*functionMock, error) {
+	var mocks map[string]*functionMock
+	switch ext {
+	case ".json":
+		d := json.NewDecoder(r)
+		d.UseNumber()
+		d.DisallowUnknownFields()
+		if err := d.Decode(&mocks); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		d := toml.NewDecoder(r)
+		d.DisallowUnknownFields()
+		if err := d.Decode(&mocks); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q (expected .toml or .json)", ext)
+	}
+	return mocks, nil
+}
+
+func (m *functionMock) runResponse() (*sdkv1.RunResponse, error) {
+	if m == nil {
+		m = &functionMock{}
+	}
+	if m.Output != nil && m.Error != nil {
+		return nil, fmt.Errorf("output and error cannot both be set")
+	}
+
+	// Errors are not retried unless the status says otherwise.
+	status := sdkv1.Status_STATUS_OK
+	if m.Error != nil {
+		status = sdkv1.Status_STATUS_PERMANENT_ERROR
+	}
+	if m.Status != "" {
+		var err error
+		if status, err = parseStatus(m.Status); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &sdkv1.CallResult{}
+	if m.Error != nil {
+		result.Error = &sdkv1.Error{
+			Type:    m.Error.Type,
+			Message: m.Error.Message,
+		}
+	}
+	if m.Output != nil {
+		output, err := newAny(m.Output)
+		if err != nil {
+			return nil, err
+		}
+		result.Output = output
+	}
+
+	return &sdkv1.RunResponse{
+		Status: status,
+		Directive: &sdkv1.RunResponse_Exit{
+			Exit: &sdkv1.Exit{Result: result},
+		},
+	}, nil
+}
+
+// newAny encodes a value decoded from a mock file the way the SDKs encode
+// function outputs: scalars are wrapped in the well-known wrapper types,
+// and objects and lists are encoded as structpb values.
+func newAny(v any) (*anypb.Any, error) {
+	var m proto.Message
+	switch v := v.(type) {
+	case bool:
+		m = wrapperspb.Bool(v)
+	case int64:
+		m = wrapperspb.Int64(v)
+	case float64:
+		m = wrapperspb.Double(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			m = wrapperspb.Int64(i)
+		} else if f, err := v.Float64(); err == nil {
+			m = wrapperspb.Double(f)
+		} else {
+			return nil, fmt.Errorf("invalid number: %s", v)
+		}
+	case string:
+		m = wrapperspb.String(v)
+	case time.Time:
+		m = timestamppb.New(v)
+	case encoding.TextMarshaler:
+		// Local dates and times of TOML files.
+		text, err := v.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		m = wrapperspb.String(string(text))
+	case map[string]any:
+		s, err := structpb.NewStruct(structValue(v).(map[string]any))
+		if err != nil {
+			return nil, err
+		}
+		m = s
+	case []any:
+		l, err := structpb.NewList(structValue(v).([]any))
+		if err != nil {
+			return nil, err
+		}
+		m = l
+	default:
+		return nil, fmt.Errorf("unsupported output type: %T", v)
+	}
+	return anypb.New(m)
+}
+
+// structValue converts the values nested in objects and lists to types
+// supported by structpb.
+func structValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case encoding.TextMarshaler:
+		text, _ := v.MarshalText()
+		return string(text)
+	case map[string]any:
+		for k, e := range v {
+			v[k] = structValue(e)
+		}
+		return v
+	case []any:
+		for i, e := range v {
+			v[i] = structValue(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestLoadMocks(t *testing.T) {
+	files := map[string]string{
+		"mocks.toml": `
+["billing.charge"]
+output = { id = "ch_123", amount = 42, tags = ["a", "b"] }
+
+["billing.count"]
+output = 42
+
+["email.send"]
+error = { type = "RateLimitError", message = "too many requests" }
+status = "temporary-error"
+
+["email.validate"]
+`,
+		"mocks.json": `{
+	"billing.charge": {"output": {"id": "ch_123", "amount": 42, "tags": ["a", "b"]}},
+	"billing.count": {"output": 42},
+	"email.send": {
+		"error": {"type": "RateLimitError", "message": "too many requests"},
+		"status": "temporary-error"
+	},
+	"email.validate": {}
+}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			mocks, err := loadMocks(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, mocks, 4)
+
+			charge := mocks["billing.charge"]
+			assert.Equal(t, sdkv1.Status_STATUS_OK, charge.Status)
+			var output structpb.Struct
+			if err := charge.GetExit().GetResult().GetOutput().UnmarshalTo(&output); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, map[string]any{
+				"id":     "ch_123",
+				"amount": float64(42),
+				"tags":   []any{"a", "b"},
+			}, output.AsMap())
+
+			var count wrapperspb.Int64Value
+			if err := mocks["billing.count"].GetExit().GetResult().GetOutput().UnmarshalTo(&count); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, int64(42), count.Value)
+
+			send := mocks["email.send"]
+			assert.Equal(t, sdkv1.Status_STATUS_TEMPORARY_ERROR, send.Status)
+			assert.Equal(t, "RateLimitError", send.GetExit().GetResult().GetError().GetType())
+			assert.Equal(t, "too many requests", send.GetExit().GetResult().GetError().GetMessage())
+
+			validate := mocks["email.validate"]
+			assert.Equal(t, sdkv1.Status_STATUS_OK, validate.Status)
+			assert.Nil(t, validate.GetExit().GetResult().GetOutput())
+		})
+	}
+}
+
+func TestLoadMocksErrors(t *testing.T) {
+	files := map[string]string{
+		"unknown-field.json":    `{"work": {"result": 1}}`,
+		"output-and-error.json": `{"work": {"output": 1, "error": {"type": "Error"}}}`,
+		"bad-status.toml":       "[work]\nstatus = \"fine\"\n",
+		"mocks.yaml":            "work: {}\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadMocks(path)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	minPollBackoff = 500 * time.Millisecond
+	maxPollBackoff = 30 * time.Second
+)
+
+// connectionState is the state of the connection to the Dispatch API, as
+// observed by the pollers.
+type connectionState int
+
+const (
+	connected connectionState = iota
+	reconnecting
+	unauthorized
+)
+
+func (s connectionState) String() string {
+	switch s {
+	case connected:
+		return "connected"
+	case reconnecting:
+		return "reconnecting"
+	case unauthorized:
+		return "unauthorized"
+	default:
+		return "unknown"
+	}
+}
+
+// pollErrorKind classifies errors that occur while polling the Dispatch
+// API for function calls.
+type pollErrorKind int
+
+const (
+	otherPollError pollErrorKind = iota
+	authPollError
+	dnsPollError
+	serverPollError
+)
+
+func (k pollErrorKind) String() string {
+	switch k {
+	case authPollError:
+		return "auth"
+	case dnsPollError:
+		return "dns"
+	case serverPollError:
+		return "server"
+	default:
+		return "other"
+	}
+}
+
+func classifyPollError(err error) pollErrorKind {
+	var dnsErr *net.DNSError
+	var statusErr pollStatusError
+	switch {
+	case errors.As(err, &authError{}):
+		return authPollError
+	case errors.As(err, &dnsErr):
+		return dnsPollError
+	case errors.As(err, &statusErr) && statusErr.statusCode >= 500:
+		return serverPollError
+	default:
+		return otherPollError
+	}
+}
+
+// pollStatusError is returned when the Dispatch API responds to a poll
+// with an unexpected status code.
+type pollStatusError struct {
+	statusCode int
+}
+
+func (e pollStatusError) Error() string {
+	return fmt.Sprintf("failed to contact Dispatch API (%s): response code %d", DispatchBridgeUrl, e.statusCode)
+}
+
+// pollerHealth tracks the health of a loop polling the Dispatch API for
+// function calls. It logs when the poller becomes unhealthy or recovers,
+// computes how long to back off after failures, and reports changes to
+// the connection state.
+type pollerHealth struct {
+	logger *slog.Logger
+	// setState is called when the connection state changes. It may be nil.
+	setState func(connectionState, error)
+
+	state        connectionState
+	failures     int
+	failingSince time.Time
+	lastKind     pollErrorKind
+}
+
+func newPollerHealth(logger *slog.Logger, setState func(connectionState, error)) *pollerHealth {
+	return &pollerHealth{logger: logger, setState: setState}
+}
+
+// success records a successful poll, whether or not a function call
+// was retrieved.
+func (h *pollerHealth) success(now time.Time) {
+	if h.failures > 0 {
+		h.logger.Info("poller recovered", "failures", h.failures, "downtime", now.Sub(h.failingSince).Truncate(time.Millisecond))
+	}
+	h.failures = 0
+	if h.state != connected {
+		h.report(connected, nil)
+	}
+}
+
+// failure records a failed poll, and returns how long the poller should
+// wait before trying again.
+//
+// A warning is logged when the poller starts failing, or when the kind of
+// error changes; repeated errors of the same kind are only logged at the
+// debug level to avoid flooding the logs during an outage.
+func (h *pollerHealth) failure(now time.Time, err error) time.Duration {
+	kind := classifyPollError(err)
+	changed := h.failures == 0 || kind != h.lastKind
+	if changed {
+		h.logger.Warn(err.Error())
+	} else {
+		h.logger.Debug(err.Error(), "failures", h.failures+1)
+	}
+	if h.failures == 0 {
+		h.failingSince = now
+	}
+	h.failures++
+	h.lastKind = kind
+
+	state, delay := reconnecting, pollBackoff(h.failures)
+	if kind == authPollError {
+		// The API key won't change while the CLI is running, so there's
+		// no point in retrying quickly.
+		state, delay = unauthorized, maxPollBackoff
+	}
+	if changed || state != h.state {
+		h.report(state, err)
+	}
+	return delay
+}
+
+func (h *pollerHealth) report(state connectionState, err error) {
+	h.state = state
+	if h.setState != nil {
+		h.setState(state, err)
+	}
+}
+
+// pollerStates aggregates the connection states reported by the pollers of
+// a session. The session is considered connected as long as one of the
+// pollers is, so that the state doesn't flap when only some of them fail.
+type pollerStates struct {
+	// setState is called when the aggregated connection state changes. It
+	// may be nil.
+	setState func(connectionState, error)
+
+	mu     sync.Mutex
+	states []connectionState
+	state  connectionState
+}
+
+func newPollerStates(pollers int, setState func(connectionState, error)) *pollerStates {
+	return &pollerStates{setState: setState, states: make([]connectionState, pollers)}
+}
+
+// reporter returns the function that the i-th poller calls when its
+// connection state changes.
+func (s *pollerStates) reporter(i int) func(connectionState, error) {
+	return func(state connectionState, err error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.states[i] = state
+		if slices.Contains(s.states, connected) {
+			if s.state == connected {
+				return
+			}
+			state, err = connected, nil
+		}
+		s.state = state
+		if s.setState != nil {
+			s.setState(state, err)
+		}
+	}
+}
+
+// pollBackoff returns a delay that grows exponentially with the number of
+// consecutive failures, capped at maxPollBackoff. Half of the delay is
+// randomized so that many pollers don't retry in lockstep.
+func pollBackoff(failures int) time.Duration {
+	delay := minPollBackoff
+	for i := 1; i < failures && delay < maxPollBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxPollBackoff)
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyPollError(t *testing.T) {
+	dnsErr := fmt.Errorf("failed to contact Dispatch API: %w", &net.DNSError{Err: "no such host", Name: "example.com"})
+
+	assert.Equal(t, authPollError, classifyPollError(authError{}))
+	assert.Equal(t, dnsPollError, classifyPollError(dnsErr))
+	assert.Equal(t, serverPollError, classifyPollError(pollStatusError{statusCode: 503}))
+	assert.Equal(t, otherPollError, classifyPollError(pollStatusError{statusCode: 400}))
+	assert.Equal(t, otherPollError, classifyPollError(errors.New("connection reset")))
+}
+
+func TestPollBackoff(t *testing.T) {
+	for failures := 1; failures < 20; failures++ {
+		delay := pollBackoff(failures)
+		assert.LessOrEqual(t, delay, maxPollBackoff)
+		assert.GreaterOrEqual(t, delay, minPollBackoff/2)
+	}
+	assert.GreaterOrEqual(t, pollBackoff(10), maxPollBackoff/2)
+}
+
+func TestPollerHealth(t *testing.T) {
+	var states []connectionState
+	health := newPollerHealth(slog.New(&slogHandler{stream: io.Discard}), func(state connectionState, err error) {
+		states = append(states, state)
+	})
+
+	now := time.Now()
+	health.success(now)
+	assert.LessOrEqual(t, health.failure(now, pollStatusError{statusCode: 502}), minPollBackoff)
+	health.failure(now, pollStatusError{statusCode: 502})
+	health.success(now)
+	assert.Equal(t, maxPollBackoff, health.failure(now, authError{}))
+
+	assert.Equal(t, []connectionState{reconnecting, connected, unauthorized}, states)
+}
+
+func TestPollerStates(t *testing.T) {
+	var states []connectionState
+	s := newPollerStates(2, func(state connectionState, err error) {
+		states = append(states, state)
+	})
+	first, second := s.reporter(0), s.reporter(1)
+
+	// The session is connected as long as one of the pollers is.
+	first(reconnecting, errors.New("connection reset"))
+	assert.Empty(t, states)
+	second(reconnecting, errors.New("connection reset"))
+	second(unauthorized, authError{})
+	first(connected, nil)
+	second(connected, nil)
+
+	assert.Equal(t, []connectionState{reconnecting, unauthorized, connected}, states)
+}
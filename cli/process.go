@@ -0,0 +1,197 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// appProcess manages the local application process. The process can be
+// started again after it has exited, e.g. to restart it when its source
+// files change.
+type appProcess struct {
+	args   []string
+	env    []string
+	output io.Writer
+	prefix []byte
+
+	mu  sync.Mutex
+	cmd *exec.Cmd
+	// output is read from the pipes until the process exits.
+	outputWG sync.WaitGroup
+}
+
+// start starts the process, and forwards its output (with a prefix) to
+// the output writer.
+func (p *appProcess) start() error {
+	cmd := exec.Command(p.args[0], p.args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Env = p.env
+
+	// Pipe stdout/stderr streams through a writer that adds a prefix,
+	// so that it's easier to disambiguate Dispatch logs from the local
+	// application's logs.
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdout.Close()
+		return fmt.Errorf("failed to create stderr pipe: %v", err)
+	}
+
+	// Set OS-specific process attributes.
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	setSysProcAttr(cmd.SysProcAttr)
+
+	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		stderr.Close()
+		code := exitCodeCannotExecute
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			code = exitCodeNotFound
+		}
+		return &exitError{
+			code: code,
+			err:  fmt.Errorf("failed to start %s: %v", strings.Join(p.args, " "), err),
+		}
+	}
+
+	p.mu.Lock()
+	p.cmd = cmd
+	p.mu.Unlock()
+
+	p.outputWG.Add(2)
+	go func() { defer p.outputWG.Done(); printPrefixedLines(p.output, stdout, p.prefix) }()
+	go func() { defer p.outputWG.Done(); printPrefixedLines(p.output, stderr, p.prefix) }()
+	return nil
+}
+
+// wait waits for the process to exit.
+func (p *appProcess) wait() error {
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+
+	// The pipes are closed by cmd.Wait, so all output must have
+	// been read before calling it.
+	p.outputWG.Wait()
+	err := cmd.Wait()
+
+	p.mu.Lock()
+	p.cmd = nil
+	p.mu.Unlock()
+	return err
+}
+
+// signal sends a signal to the process and its children, if the process
+// is running. It returns false if the process is not running.
+func (p *appProcess) signal(s os.Signal) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd == nil || p.cmd.Process == nil || p.cmd.Process.Pid <= 0 {
+		return false
+	}
+	killProcess(p.cmd.Process, s)
+	return true
+}
+
+// stop asks the process to terminate, and kills it if it hasn't exited
+// after the timeout. The exited channel receives the result of wait.
+func (p *appProcess) stop(exited <-chan error, timeout time.Duration) error {
+	p.signal(syscall.SIGTERM)
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-exited:
+		return err
+	case <-t.C:
+		p.signal(os.Kill)
+		return <-exited
+	}
+}
+
+// kill kills the process, if it's running.
+func (p *appProcess) kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd != nil && p.cmd.Process != nil {
+		_ = p.cmd.Process.Kill()
+	}
+}
+
+// processExitCode returns the exit code of a process that exited with
+// the error returned by wait, or 128+n if it was terminated by signal n.
+// It returns false if the error isn't an exit status.
+func processExitCode(err error) (int, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, false
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), true
+	}
+	return exitErr.ExitCode(), true
+}
+
+// restartPolicy determines whether the local application is restarted
+// after it exits.
+type restartPolicy string
+
+const (
+	restartNever     restartPolicy = "no"
+	restartOnFailure restartPolicy = "on-failure"
+	restartAlways    restartPolicy = "always"
+)
+
+const (
+	minRestartBackoff = 1 * time.Second
+	maxRestartBackoff = 30 * time.Second
+
+	// restartResetPeriod is how long the local application must run for
+	// before its restart count and backoff are reset.
+	restartResetPeriod = time.Minute
+)
+
+func parseRestartPolicy(s string) (restartPolicy, error) {
+	switch p := restartPolicy(s); p {
+	case restartNever, restartOnFailure, restartAlways:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid restart policy: %q (expected no, on-failure or always)", s)
+	}
+}
+
+// shouldRestart returns true if the local application should be restarted
+// after exiting with the specified error.
+func (p restartPolicy) shouldRestart(err error) bool {
+	switch p {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return err != nil
+	default:
+		return false
+	}
+}
+
+// restartBackoff returns the delay before the nth consecutive restart of
+// the local application.
+func restartBackoff(restarts int) time.Duration {
+	delay := minRestartBackoff
+	for i := 1; i < restarts && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRestartBackoff)
+}
@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		success bool
+		failure bool
+	}{
+		{policy: "no", success: false, failure: false},
+		{policy: "on-failure", success: false, failure: true},
+		{policy: "always", success: true, failure: true},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			policy, err := parseRestartPolicy(test.policy)
+			assert.NoError(t, err)
+			assert.Equal(t, test.success, policy.shouldRestart(nil))
+			assert.Equal(t, test.failure, policy.shouldRestart(errors.New("exit status 1")))
+		})
+	}
+
+	_, err := parseRestartPolicy("sometimes")
+	assert.Error(t, err)
+}
+
+func TestRestartBackoff(t *testing.T) {
+	assert.Equal(t, 1*time.Second, restartBackoff(1))
+	assert.Equal(t, 2*time.Second, restartBackoff(2))
+	assert.Equal(t, 4*time.Second, restartBackoff(3))
+	assert.Equal(t, maxRestartBackoff, restartBackoff(10))
+	assert.Equal(t, maxRestartBackoff, restartBackoff(1000))
+}
+
+func TestProcessExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	tests := []struct {
+		script string
+		code   int
+	}{
+		{script: "exit 0", code: 0},
+		{script: "exit 3", code: 3},
+		{script: "kill -TERM $$", code: 128 + 15},
+		{script: "kill -KILL $$", code: 128 + 9},
+	}
+	for _, test := range tests {
+		t.Run(test.script, func(t *testing.T) {
+			err := exec.Command("sh", "-c", test.script).Run()
+			code, ok := processExitCode(err)
+			if test.code == 0 {
+				assert.False(t, ok)
+				return
+			}
+			assert.True(t, ok)
+			assert.Equal(t, test.code, code)
+		})
+	}
+
+	_, ok := processExitCode(errors.New("not an exit status"))
+	assert.False(t, ok)
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, 1, ExitCode(errors.New("failure")))
+	assert.Equal(t, exitCodeError, ExitCode(runError(errors.New("failure"))))
+	assert.Equal(t, 3, ExitCode(&exitError{code: 3, err: errors.New("exit status 3")}))
+	assert.Equal(t, 3, ExitCode(fmt.Errorf("wrapped: %w", &exitError{code: 3, err: errors.New("exit status 3")})))
+
+	p := &appProcess{args: []string{"dispatch-command-not-found"}}
+	assert.Equal(t, exitCodeNotFound, ExitCode(p.start()))
+}
+
+func TestAppExitError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	tests := []struct {
+		script string
+		code   int
+	}{
+		{script: "exit 0", code: 0},
+		{script: "exit 3", code: 3},
+		{script: "kill -TERM $$", code: 128 + 15},
+		{script: "kill -INT $$", code: 128 + 2},
+	}
+	for _, test := range tests {
+		t.Run(test.script, func(t *testing.T) {
+			args := []string{"sh", "-c", test.script}
+			err := appExitError(args, exec.Command(args[0], args[1:]...).Run())
+			assert.Equal(t, test.code, ExitCode(err))
+			if test.code != 0 {
+				assert.ErrorContains(t, err, "failed to invoke command 'sh -c "+test.script+"'")
+			}
+		})
+	}
+
+	assert.Equal(t, exitCodeError, ExitCode(appExitError(nil, errors.New("not an exit status"))))
+}
@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadyTimeout = 30 * time.Second
+	minReadyInterval    = 50 * time.Millisecond
+	maxReadyInterval    = time.Second
+)
+
+// readyGate holds function calls while the local application is not ready
+// to accept them, e.g. while it's starting or restarting.
+type readyGate struct {
+	mu     sync.Mutex
+	ch     chan struct{}
+	isOpen bool
+}
+
+func newReadyGate() *readyGate {
+	return &readyGate{ch: make(chan struct{})}
+}
+
+// wait blocks until the gate is open. It returns false if the context was
+// canceled before then.
+func (g *readyGate) wait(ctx context.Context) bool {
+	g.mu.Lock()
+	ch := g.ch
+	g.mu.Unlock()
+
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// openUnlessCanceled lets function calls through, unless the context was
+// canceled. The context is checked while holding the lock, so the gate
+// stays closed if the context is canceled before a call to close, even if
+// both race with this call.
+func (g *readyGate) openUnlessCanceled(ctx context.Context) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return false
+	}
+	if !g.isOpen {
+		close(g.ch)
+		g.isOpen = true
+	}
+	return true
+}
+
+// openWhenReady opens the gate once the local application endpoint is
+// ready, or the timeout expires. The gate is left closed if the context is
+// canceled, e.g. because the local application exited or is restarted in
+// the meantime. A zero timeout means no timeout.
+func (g *readyGate) openWhenReady(ctx context.Context, client *http.Client, path string, timeout time.Duration) error {
+	err := waitUntilReady(ctx, client, path, timeout)
+	if !g.openUnlessCanceled(ctx) {
+		return ctx.Err()
+	}
+	return err
+}
+
+// close holds function calls until the gate is opened again.
+func (g *readyGate) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.isOpen {
+		g.ch = make(chan struct{})
+		g.isOpen = false
+	}
+}
+
+// waitUntilReady blocks until the local application endpoint is ready to
+// accept function calls, the timeout expires, or the context is canceled.
+//
+// When path is empty, the endpoint is ready once it accepts TCP
+// connections. Otherwise, the endpoint is ready once a GET request to the
+// path returns a 2xx status code. A zero timeout means no timeout.
+func waitUntilReady(ctx context.Context, client *http.Client, path string, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	interval := minReadyInterval
+	for {
+		if probeEndpoint(ctx, client, path) {
+			return nil
+		}
+
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("local application is not ready after %v, forwarding function calls anyway (see --ready-timeout)", timeout)
+			}
+			return ctx.Err()
+		case <-t.C:
+		}
+		interval = min(interval*2, maxReadyInterval)
+	}
+}
+
+func probeEndpoint(ctx context.Context, client *http.Client, path string) bool {
+	if path == "" {
+		return checkEndpoint(LocalEndpoint, time.Second)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, maxReadyInterval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpointRequestURL(path), nil)
+	if err != nil {
+		panic(err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		slog.Debug("endpoint is not ready", "path", path, "err", err)
+		return false
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		slog.Debug("endpoint is not ready", "path", path, "status", res.StatusCode)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitUntilReady(t *testing.T) {
+	var probes int64
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		if atomic.AddInt64(&probes, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer app.Close()
+
+	oldEndpoint := LocalEndpoint
+	LocalEndpoint = app.Listener.Addr().String()
+	defer func() { LocalEndpoint = oldEndpoint }()
+	ctx := context.Background()
+
+	t.Run("TCP", func(t *testing.T) {
+		assert.NoError(t, waitUntilReady(ctx, http.DefaultClient, "", time.Second))
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		assert.NoError(t, waitUntilReady(ctx, http.DefaultClient, "health", 5*time.Second))
+		assert.Equal(t, int64(3), atomic.LoadInt64(&probes))
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		app.Close()
+		err := waitUntilReady(ctx, http.DefaultClient, "", 200*time.Millisecond)
+		assert.ErrorContains(t, err, "--ready-timeout")
+	})
+}
+
+func TestReadyGateRestart(t *testing.T) {
+	var healthy atomic.Bool
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer app.Close()
+
+	oldEndpoint := LocalEndpoint
+	LocalEndpoint = app.Listener.Addr().String()
+	defer func() { LocalEndpoint = oldEndpoint }()
+
+	isOpen := func(g *readyGate) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		return g.wait(ctx)
+	}
+
+	gate := newReadyGate()
+
+	// The application is restarted while waiting for it to be ready: the
+	// wait is canceled and the gate closed, as the run command does.
+	readyCtx, cancelReady := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- gate.openWhenReady(readyCtx, http.DefaultClient, "/health", 0) }()
+	time.Sleep(20 * time.Millisecond)
+	cancelReady()
+	gate.close()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.False(t, isOpen(gate))
+
+	// The gate opens once the restarted application is ready.
+	readyCtx, cancelReady = context.WithCancel(context.Background())
+	defer cancelReady()
+	go func() { done <- gate.openWhenReady(readyCtx, http.DefaultClient, "/health", 0) }()
+	assert.False(t, isOpen(gate))
+	healthy.Store(true)
+	assert.NoError(t, <-done)
+	assert.True(t, isOpen(gate))
+
+	// A canceled wait never opens the gate, even if it completes at the
+	// same time.
+	gate.close()
+	cancelReady()
+	assert.False(t, gate.openUnlessCanceled(readyCtx))
+	assert.False(t, isOpen(gate))
+}
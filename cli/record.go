@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// sessionRecord is an entry in a session recording.
+//
+// Recordings are newline-delimited JSON documents. Each RunRequest observed
+// during the session produces a "request" record, followed later by a
+// "response" record with the same sequence number. Protocol buffer messages
+// are stored in their binary form (base64 encoded), so that they can be
+// replayed exactly, even if they contain values of types that are unknown
+// to the CLI.
+type sessionRecord struct {
+	Type       string    `json:"type"`
+	Seq        int64     `json:"seq"`
+	Time       time.Time `json:"time"`
+	DispatchID string    `json:"dispatch_id"`
+	Function   string    `json:"function"`
+	Request    []byte    `json:"request,omitempty"`
+	Response   []byte    `json:"response,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	HTTPStatus int       `json:"http_status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	// Synthetic is true if the response was generated by the CLI instead
+	// of the local application, e.g. for mocked or skipped functions.
+	Synthetic bool `json:"synthetic,omitempty"`
+}
+
+const (
+	requestRecord  = "request"
+	responseRecord = "response"
+)
+
+// sessionRecorder is a FunctionCallObserver that writes the requests and
+// responses it observes to a session recording.
+type sessionRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	seq int64
+	// RunRequests are passed by pointer to both ObserveRequest and
+	// ObserveResponse, which is used to pair responses with requests.
+	pending map[*sdkv1.RunRequest]int64
+}
+
+func newSessionRecorder(w io.Writer) *sessionRecorder {
+	return &sessionRecorder{
+		enc:     json.NewEncoder(w),
+		pending: map[*sdkv1.RunRequest]int64{},
+	}
+}
+
+func (r *sessionRecorder) ObserveRequest(now time.Time, req *sdkv1.RunRequest) {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		slog.Debug("cannot record request", "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seq++
+	r.pending[req] = r.seq
+
+	r.write(&sessionRecord{
+		Type:       requestRecord,
+		Seq:        r.seq,
+		Time:       now,
+		DispatchID: req.DispatchId,
+		Function:   req.Function,
+		Request:    b,
+	})
+}
+
+func (r *sessionRecorder) ObserveResponse(now time.Time, req *sdkv1.RunRequest, err error, httpRes *http.Response, res *sdkv1.RunResponse) {
+	record := &sessionRecord{
+		Type:       responseRecord,
+		Time:       now,
+		DispatchID: req.DispatchId,
+		Function:   req.Function,
+	}
+	if res != nil {
+		b, err := proto.Marshal(res)
+		if err != nil {
+			slog.Debug("cannot record response", "error", err)
+			return
+		}
+		record.Response = b
+		record.Status = res.Status.String()
+	}
+	if httpRes != nil {
+		record.HTTPStatus = httpRes.StatusCode
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.Synthetic = isSynthetic(err, httpRes)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seq, ok := r.pending[req]
+	if !ok {
+		return
+	}
+	delete(r.pending, req)
+	record.Seq = seq
+
+	r.write(record)
+}
+
+// readSessionRecords reads the records of a session recording.
+func readSessionRecords(r io.Reader) ([]sessionRecord, error) {
+	var records []sessionRecord
+	dec := json.NewDecoder(r)
+	for {
+		var record sessionRecord
+		if err := dec.Decode(&record); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func (r *sessionRecorder) write(record *sessionRecord) {
+	if err := r.enc.Encode(record); err != nil {
+		slog.Warn("failed to write session recording", "error", err)
+	}
+}
@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSessionRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := newSessionRecorder(&buf)
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	req1 := &sdkv1.RunRequest{Function: "a", DispatchId: "1"}
+	req2 := &sdkv1.RunRequest{Function: "b", DispatchId: "2"}
+	res1 := &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK}
+
+	recorder.ObserveRequest(now, req1)
+	recorder.ObserveRequest(now, req2)
+	recorder.ObserveResponse(now, req2, errors.New("connection refused"), nil, nil)
+	recorder.ObserveResponse(now, req1, nil, &http.Response{StatusCode: 200}, res1)
+
+	records, err := readSessionRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, records, 4)
+	assert.Equal(t, requestRecord, records[0].Type)
+	assert.Equal(t, int64(1), records[0].Seq)
+	assert.Equal(t, "a", records[0].Function)
+	assert.True(t, now.Equal(records[0].Time))
+
+	var req sdkv1.RunRequest
+	assert.NoError(t, proto.Unmarshal(records[1].Request, &req))
+	assert.True(t, proto.Equal(req2, &req))
+
+	assert.Equal(t, responseRecord, records[2].Type)
+	assert.Equal(t, int64(2), records[2].Seq)
+	assert.Equal(t, "connection refused", records[2].Error)
+	assert.Nil(t, records[2].Response)
+
+	assert.Equal(t, int64(1), records[3].Seq)
+	assert.Equal(t, 200, records[3].HTTPStatus)
+	assert.Equal(t, "STATUS_OK", records[3].Status)
+	assert.False(t, records[3].Synthetic)
+	var res sdkv1.RunResponse
+	assert.NoError(t, proto.Unmarshal(records[3].Response, &res))
+	assert.True(t, proto.Equal(res1, &res))
+
+	// Responses generated by the CLI, and dropped calls, are marked.
+	buf.Reset()
+	recorder.ObserveRequest(now, req1)
+	recorder.ObserveResponse(now, req1, nil, syntheticRunResponse(res1), res1)
+	recorder.ObserveRequest(now, req2)
+	recorder.ObserveResponse(now, req2, faultDrop, nil, nil)
+	records, err = readSessionRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 4)
+	assert.True(t, records[1].Synthetic)
+	assert.True(t, records[3].Synthetic)
+}
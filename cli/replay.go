@@ -0,0 +1,263 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func replayCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replay <file>",
+		Short: "Replay a recorded Dispatch session",
+		Long: fmt.Sprintf(`Replay a recorded Dispatch session.
+
+The replay command reads a session recorded with 'dispatch run --record'
+and sends each recorded request to the local application endpoint, one
+at a time and in the order they were recorded. The response of the local
+application is then compared with the recorded response.
+
+The local application must already be running and listening on
+http://%s. If the local application is listening on a different host
+or port, please set the --endpoint option appropriately.
+
+Requests that were responded to by the CLI instead of the local
+application, e.g. calls to functions stubbed with --mock or --skip, faults
+injected with --chaos, or calls vetoed with --hook, are not replayed.
+
+The command fails if any of the responses differ from the recording.`, defaultEndpoint),
+		Args:         cobra.ExactArgs(1),
+		GroupID:      "dispatch",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateEndpoint(LocalEndpoint); err != nil {
+				return err
+			}
+
+			f, err := os.Open(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to open session recording: %v", err)
+			}
+			defer f.Close()
+
+			var logWriter io.Writer = io.Discard
+			if Verbose {
+				logWriter = os.Stderr
+			}
+			logger := slog.New(&slogHandler{stream: logWriter})
+
+			client, err := newEndpointClient(CallTimeout)
+			if err != nil {
+				return err
+			}
+
+			replayed, mismatches, err := replaySession(cmd.Context(), client, f, cmd.OutOrStdout(), logger)
+			if err != nil {
+				return err
+			}
+			simple(cmd, fmt.Sprintf("\n%d requests replayed, %d mismatches", replayed, mismatches))
+			if mismatches > 0 {
+				return fmt.Errorf("replayed responses differ from the recording")
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&LocalEndpoint, "endpoint", "e", defaultEndpoint, "Host:port, https://host:port or unix:///path.sock that the local application endpoint is listening on")
+	cmd.Flags().StringVarP(&EndpointCAFile, "endpoint-ca", "", "", "CA certificate (PEM) used to verify an https:// endpoint")
+	cmd.Flags().BoolVarP(&EndpointInsecure, "endpoint-insecure", "", false, "Skip verification of the certificate of an https:// endpoint")
+	cmd.Flags().BoolVarP(&EndpointH2C, "endpoint-h2c", "", false, "Use HTTP/2 over cleartext (h2c) to talk to the endpoint")
+	cmd.Flags().DurationVarP(&CallTimeout, "call-timeout", "", defaultCallTimeout, "Timeout for requests to the local application (0 = no timeout)")
+	cmd.Flags().BoolVarP(&Verbose, "verbose", "", false, "Enable verbose logging")
+
+	return cmd
+}
+
+// replaySession sends the requests of a session recording to the local
+// application, and reports differences between the recorded and replayed
+// responses to w.
+func replaySession(ctx context.Context, client *http.Client, r io.Reader, w io.Writer, logger *slog.Logger) (replayed, mismatches int, err error) {
+	records, err := readSessionRecords(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid session recording: %v", err)
+	}
+
+	responses := map[int64]*sessionRecord{}
+	for i := range records {
+		if records[i].Type == responseRecord {
+			responses[records[i].Seq] = &records[i]
+		}
+	}
+
+	for i := range records {
+		record := &records[i]
+		if record.Type != requestRecord {
+			continue
+		}
+
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(record.Request, &req); err != nil {
+			return replayed, mismatches, fmt.Errorf("invalid request #%d in session recording: %v", record.Seq, err)
+		}
+
+		// Requests that the local application didn't handle are not
+		// replayed, since they might trigger the side effects that the
+		// CLI stubbed out.
+		expected, ok := responses[record.Seq]
+		if ok && expected.Synthetic {
+			fmt.Fprintf(w, "%s %s %s\n", pendingIcon, req.Function, pendingStyle.Render("(responded by the CLI, not replayed)"))
+			continue
+		}
+
+		// Recorded requests have most likely expired by now, but they
+		// must be replayed regardless.
+		req.ExpirationTime = nil
+		endpointReq := newEndpointRequest(ctx, nil)
+		setRequestBody(endpointReq, &req)
+
+		endpointRes, res, err := callEndpoint(ctx, client, endpointReq, &req, logger, nil, nil)
+		if ctx.Err() != nil {
+			return replayed, mismatches, ctx.Err()
+		}
+		replayed++
+
+		actual := replayResult{response: res, err: err}
+		if endpointRes != nil {
+			actual.httpStatus = endpointRes.StatusCode
+		}
+
+		if !ok {
+			// The session ended before a response was recorded, there's
+			// nothing to compare to.
+			fmt.Fprintf(w, "%s %s %s\n", pendingIcon, req.Function, pendingStyle.Render("(no recorded response)"))
+			continue
+		}
+		recorded, err := recordedResult(expected)
+		if err != nil {
+			return replayed, mismatches, fmt.Errorf("invalid response #%d in session recording: %v", record.Seq, err)
+		}
+
+		if diffs := diffReplayResults(recorded, actual); len(diffs) > 0 {
+			mismatches++
+			fmt.Fprintf(w, "%s %s\n", errorStyle.Render(failureIcon), errorStyle.Render(req.Function))
+			for _, diff := range diffs {
+				fmt.Fprintf(w, "    %s\n", diff)
+			}
+		} else {
+			fmt.Fprintf(w, "%s %s\n", okStyle.Render(successIcon), req.Function)
+		}
+	}
+	return replayed, mismatches, nil
+}
+
+type replayResult struct {
+	response   *sdkv1.RunResponse
+	httpStatus int
+	err        error
+}
+
+func recordedResult(record *sessionRecord) (replayResult, error) {
+	result := replayResult{httpStatus: record.HTTPStatus}
+	if record.Response != nil {
+		result.response = &sdkv1.RunResponse{}
+		if err := proto.Unmarshal(record.Response, result.response); err != nil {
+			return result, err
+		}
+	}
+	if record.Error != "" {
+		result.err = fmt.Errorf("%s", record.Error)
+	}
+	return result, nil
+}
+
+// diffReplayResults returns a description of the differences between the
+// recorded and replayed results.
+//
+// Opaque coroutine states are not compared, since they are expected to
+// differ between runs. Errors contacting the local application are only
+// compared by presence, since their messages may contain addresses or other
+// details that are specific to a run.
+func diffReplayResults(recorded, replayed replayResult) []string {
+	var diffs []string
+	diff := func(name, before, after string) {
+		if before != after {
+			diffs = append(diffs, fmt.Sprintf("%s: recorded %s, replayed %s", name, before, after))
+		}
+	}
+
+	if recorded.err != nil || replayed.err != nil {
+		if (recorded.err == nil) != (replayed.err == nil) {
+			diffs = append(diffs, fmt.Sprintf("error: recorded %s, replayed %s", errorString(recorded.err), errorString(replayed.err)))
+		}
+		return diffs
+	}
+	diff("http status", fmt.Sprint(recorded.httpStatus), fmt.Sprint(replayed.httpStatus))
+
+	expected, actual := recorded.response, replayed.response
+	if expected == nil || actual == nil {
+		diff("response", responseKind(expected), responseKind(actual))
+		return diffs
+	}
+
+	diff("status", statusString(expected.Status), statusString(actual.Status))
+	diff("directive", responseKind(expected), responseKind(actual))
+
+	switch {
+	case expected.GetExit() != nil && actual.GetExit() != nil:
+		expectedResult, actualResult := expected.GetExit().GetResult(), actual.GetExit().GetResult()
+		if !anyEqual(expectedResult.GetOutput(), actualResult.GetOutput()) {
+			diff("output", anyString(expectedResult.GetOutput()), anyString(actualResult.GetOutput()))
+		}
+		diff("error type", expectedResult.GetError().GetType(), actualResult.GetError().GetType())
+		diff("error message", expectedResult.GetError().GetMessage(), actualResult.GetError().GetMessage())
+		diff("tail call", expected.GetExit().GetTailCall().GetFunction(), actual.GetExit().GetTailCall().GetFunction())
+
+	case expected.GetPoll() != nil && actual.GetPoll() != nil:
+		expectedCalls, actualCalls := callFunctions(expected.GetPoll().GetCalls()), callFunctions(actual.GetPoll().GetCalls())
+		if !slices.Equal(expectedCalls, actualCalls) {
+			diff("calls", fmt.Sprint(expectedCalls), fmt.Sprint(actualCalls))
+		}
+	}
+	return diffs
+}
+
+func anyEqual(a, b *anypb.Any) bool {
+	return proto.Equal(a, b) || anyString(a) == anyString(b)
+}
+
+func errorString(err error) string {
+	if err != nil {
+		return fmt.Sprintf("%q", err.Error())
+	}
+	return "none"
+}
+
+func responseKind(res *sdkv1.RunResponse) string {
+	switch {
+	case res == nil:
+		return "none"
+	case res.GetExit() != nil:
+		return "exit"
+	case res.GetPoll() != nil:
+		return "poll"
+	default:
+		return "unknown"
+	}
+}
+
+func callFunctions(calls []*sdkv1.Call) []string {
+	functions := make([]string, len(calls))
+	for i, call := range calls {
+		functions[i] = call.Function
+	}
+	return functions
+}
@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestReplaySession(t *testing.T) {
+	// The local application echoes the function name, except for the
+	// "changed" function which now returns a different output.
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+		if req.Function == "mocked" {
+			t.Error("mocked function call was replayed")
+		}
+		if req.ExpirationTime != nil {
+			t.Error("expired function call was replayed with its expiration time")
+		}
+		output := req.Function
+		if output == "changed" {
+			output = "something else"
+		}
+		b, _ := proto.Marshal(exitResponse(output))
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	}))
+	defer app.Close()
+
+	oldEndpoint := LocalEndpoint
+	LocalEndpoint = app.Listener.Addr().String()
+	defer func() { LocalEndpoint = oldEndpoint }()
+
+	var recording bytes.Buffer
+	recorder := newSessionRecorder(&recording)
+	now := time.Now()
+	for _, function := range []string{"same", "changed"} {
+		req := &sdkv1.RunRequest{Function: function, DispatchId: function, ExpirationTime: timestamppb.New(now)}
+		recorder.ObserveRequest(now, req)
+		recorder.ObserveResponse(now, req, nil, &http.Response{StatusCode: http.StatusOK}, exitResponse(function))
+	}
+
+	// Responses generated by the CLI are not replayed.
+	mocked := &sdkv1.RunRequest{Function: "mocked", DispatchId: "mocked"}
+	recorder.ObserveRequest(now, mocked)
+	recorder.ObserveResponse(now, mocked, nil, syntheticRunResponse(exitResponse("mocked")), exitResponse("mocked"))
+
+	var output strings.Builder
+	logger := slog.New(&slogHandler{stream: io.Discard})
+	replayed, mismatches, err := replaySession(context.Background(), http.DefaultClient, &recording, &output, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, 1, mismatches)
+	assert.Contains(t, output.String(), `output: recorded "changed", replayed "something else"`)
+	assert.Contains(t, output.String(), "mocked (responded by the CLI, not replayed)")
+}
+
+func TestDiffReplayResults(t *testing.T) {
+	ok := replayResult{response: exitResponse("a"), httpStatus: http.StatusOK}
+
+	assert.Empty(t, diffReplayResults(ok, ok))
+	assert.Equal(t,
+		[]string{"http status: recorded 200, replayed 404", "response: recorded exit, replayed none"},
+		diffReplayResults(ok, replayResult{httpStatus: http.StatusNotFound}))
+	assert.Equal(t,
+		[]string{`error: recorded none, replayed "connection refused"`},
+		diffReplayResults(ok, replayResult{err: errConnectionRefused}))
+
+	failed := replayResult{
+		response:   &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_TEMPORARY_ERROR, Directive: &sdkv1.RunResponse_Poll{Poll: &sdkv1.Poll{}}},
+		httpStatus: http.StatusOK,
+	}
+	assert.Equal(t,
+		[]string{"status: recorded OK, replayed Temporary error", "directive: recorded exit, replayed poll"},
+		diffReplayResults(ok, failed))
+}
+
+func exitResponse(output string) *sdkv1.RunResponse {
+	any, _ := anypb.New(wrapperspb.String(output))
+	return &sdkv1.RunResponse{
+		Status:    sdkv1.Status_STATUS_OK,
+		Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{Result: &sdkv1.CallResult{Output: any}}},
+	}
+}
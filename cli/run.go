@@ -13,7 +13,6 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
@@ -33,21 +32,43 @@ import (
 )
 
 var (
-	BridgeSession string
-	LocalEndpoint string
-	Verbose       bool
+	BridgeSession   string
+	LocalEndpoint   string
+	LocalMode       bool
+	RecordPath      string
+	MaxConcurrency  int
+	Pollers         int
+	PollTimeout     time.Duration
+	CallTimeout     time.Duration
+	ReadyTimeout    time.Duration
+	ReadyPath       string
+	WatchPatterns   []string
+	Attach          bool
+	SignRequests    bool
+	ShutdownTimeout time.Duration
+	RestartPolicy   string
+	MaxRestarts     int
+	Verbose         bool
 )
 
 const defaultEndpoint = "127.0.0.1:8000"
 
 const (
-	pollTimeout    = 30 * time.Second
-	cleanupTimeout = 5 * time.Second
+	defaultPollTimeout     = 30 * time.Second
+	restartTimeout         = 5 * time.Second
+	defaultCallTimeout     = 5 * time.Minute
+	defaultShutdownTimeout = 10 * time.Second
+	defaultMaxRestarts     = 5
+	cleanupTimeout         = 5 * time.Second
 )
 
-var httpClient = &http.Client{
-	Transport: http.DefaultTransport,
-	Timeout:   pollTimeout,
+// newHTTPClient creates an HTTP client with the specified timeout. A zero
+// timeout means no timeout.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: http.DefaultTransport,
+		Timeout:   timeout,
+	}
 }
 
 var (
@@ -76,36 +97,360 @@ please set the --endpoint option appropriately. The value passed to
 this option will be exported as the DISPATCH_ENDPOINT_ADDR environment
 variable to the local application.
 
+The local application endpoint can also listen on a unix domain socket,
+e.g. --endpoint unix:///tmp/app.sock, which avoids port collisions when
+several applications run on the same host. In this case, the path of the
+socket is exported as the DISPATCH_ENDPOINT_ADDR environment variable.
+
+Use --endpoint auto to pick a free port on the loopback interface, so
+that several sessions can run side by side. The local application must
+then listen on the address exported as DISPATCH_ENDPOINT_ADDR.
+
+If the local application endpoint serves HTTPS, e.g. behind a TLS
+terminating proxy, set --endpoint to an https:// URL. The certificate of
+the endpoint is verified using the system's CAs, and the CA set with the
+--endpoint-ca option. Use --endpoint-insecure to skip the verification.
+HTTP/2 is negotiated with the endpoint over TLS when possible. The
+--endpoint-h2c option uses HTTP/2 over cleartext connections instead.
+
 A new session is created each time the command is run. A session is
 a pristine environment in which function calls can be dispatched and
 handled by the local application. To start the command using a previous
 session, use the --session option to specify a session ID from a
-previous run.`, defaultEndpoint),
-		Args:    cobra.MinimumNArgs(1),
+previous run.
+
+When the --local option is set, function calls are not retrieved from
+Dispatch. Instead, the CLI runs an in-process scheduler which accepts
+calls from the local application and drives them to completion. This
+mode does not require an API key nor network access, which is useful
+when Dispatch cannot be reached. Sessions cannot be resumed in this
+mode.
+
+The --max-concurrency option limits the number of requests that are sent
+to the local application concurrently. When the limit is reached, no new
+function calls are retrieved until an in-flight request completes.
+
+By default, function calls are retrieved from Dispatch using a single
+long-polling loop. The --pollers option runs multiple loops concurrently
+within the same session, which reduces the latency of picking up new
+function calls when many of them are dispatched at once.
+
+Requests to the local application are cancelled if they don't complete
+within the --call-timeout. Long-polling requests to Dispatch, and other
+requests to the Dispatch API, use the --poll-timeout instead.
+
+Function calls are not forwarded until the local application is ready.
+By default, the local application is considered ready once it accepts
+connections on the endpoint. The --ready-path option can be used to
+probe an HTTP path instead, which must return a 2xx status code. If the
+local application isn't ready within the --ready-timeout, function calls
+are forwarded anyway. Set --ready-timeout=0 to disable the readiness check.
+
+The --watch option restarts the local application when files matching
+a pattern change, e.g. --watch '*.py'. Patterns without a slash match
+file names in any directory under the working directory, while other
+patterns match paths relative to the working directory, where '**'
+matches any number of directories. The session, and the function calls
+that are pending, are preserved across restarts. The option can be
+repeated to watch multiple patterns.
+
+The --attach option bridges function calls to an application that is
+already running and listening on the endpoint, e.g. one started in a
+debugger or a container, instead of spawning a command. Since the CLI
+cannot set the application's environment in this mode, it prints the
+DISPATCH_* environment variables that the application must be started
+with. Unless the --ready-timeout option is set, function calls are held
+until the application is listening on the endpoint.
+
+The --sign-requests option signs the requests sent to the local
+application with an ephemeral ed25519 key, the same way Dispatch signs
+requests in production, and exports the public key as the
+DISPATCH_VERIFICATION_KEY environment variable. This exercises the
+request verification of the local application during development.
+
+When interrupted, the CLI stops retrieving function calls and waits
+for the in-flight calls to complete, and their responses to be sent,
+before forwarding the signal to the local application. The wait is
+bounded by the --shutdown-timeout option (0 = don't wait). Interrupt
+the CLI a second time to skip the wait.
+
+By default, the session ends when the local application exits. The
+--restart option restarts it instead, either when it exits with an
+error (on-failure) or whenever it exits (always). The session, and the
+function calls that are pending, are preserved across restarts. The
+delay between restarts grows exponentially, and the CLI gives up after
+--max-restarts consecutive restarts (0 = no limit). The count is reset
+once the application has been running for a minute.
+
+The --chaos option injects faults in function calls, to exercise the
+retry behavior of the local application and of Dispatch. The faults are
+injected in --chaos-rate percent of the function calls, or of the calls
+to the functions set with --chaos-function. A random fault is picked
+among those passed to the option:
+
+  drop         the request is not forwarded, and is not responded to
+  delay        the request is forwarded after the --chaos-delay
+  error        a STATUS_TEMPORARY_ERROR response is sent to Dispatch
+  unavailable  an HTTP 503 response is sent to Dispatch
+  cut          the response sent to Dispatch is cut in the middle
+
+This option cannot be used with --local.
+
+The --only and --skip options filter the function calls forwarded to the
+local application, by matching function names against shell patterns,
+e.g. 'billing.*'. When --only is set, only calls to the matching
+functions are forwarded, and calls to functions that match --skip are
+never forwarded. Calls that are filtered out are responded to with the
+--skip-status instead (e.g. ok, temporary-error or permanent-error),
+which stubs out parts of a workflow. Both options can be repeated.
+
+The --mock option stubs functions with canned responses, e.g. functions
+that call paid third-party APIs. Calls to these functions are responded
+to by the CLI instead of being forwarded to the local application. The
+canned responses are read from a TOML or JSON file which maps function
+names to their output, or to an error:
+
+  ["billing.charge"]
+  output = { id = "ch_123", amount = 42 }
+
+  ["email.send"]
+  error = { type = "RateLimitError", message = "too many requests" }
+  status = "temporary-error"
+
+Outputs are encoded the same way the SDKs encode them. Responses have
+the OK status, or the permanent-error status for errors, unless the
+status is set.
+
+The --hook option runs a command for each function call forwarded to the
+local application, before the request is forwarded and again after the
+response is received. The command receives the call on stdin, as a JSON
+object with the "event" (request or response), and the "request" and
+"response" encoded as JSON. It vetoes the call by exiting with a
+non-zero status, in which case the call fails with a permanent error
+and the stderr of the command as error message. It can also write a
+JSON object to stdout, with a modified "request" or "response" to send
+instead, and "annotations" to log with the call:
+
+  {"annotations": {"schema": "v2"}}
+
+The command runs with sh -c, and is killed if it runs for more than
+10 seconds. If it cannot be run, is killed, or writes an invalid JSON
+object, the call fails with a temporary error, and is retried.
+
+The command exits with the exit status of the local application, or
+128+n if the application was terminated by signal n, including when the
+command itself is interrupted. Exit codes 125 to 127 are reserved for
+failures of the CLI itself: 125 if the CLI fails, 126 if the command
+cannot be executed, and 127 if it cannot be found.
+
+The --metrics-addr option serves metrics about function calls in the
+Prometheus text format, at the /metrics path of the address, e.g.
+localhost:9090. The metrics include the number of calls by function and
+status, the number of attempts, the latency of the local application,
+the number of calls in flight, the number of bytes forwarded, and the
+number of errors polling Dispatch.
+
+The --trace-endpoint and --trace-file options export function calls as
+OpenTelemetry traces, to view workflow executions in tools like Jaeger.
+Each function call is a span, which is the child of the span of the
+function that called it, and whose events are the round-trips to the
+local application. Traces are sent to an OTLP/HTTP collector (e.g.
+http://localhost:4318), or written to a file in the OTLP/JSON format.
+
+The --record option writes every request sent to the local application,
+and every response received from it, to a newline-delimited JSON file.
+Recordings can be attached to bug reports, or replayed later on.`, defaultEndpoint),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if Attach {
+				if len(args) > 0 {
+					return fmt.Errorf("a command cannot be specified with --attach")
+				}
+				return nil
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
 		GroupID: "dispatch",
 		PreRunE: func(cmd *cobra.Command, args []string) error {
-			return runConfigFlow()
+			if LocalMode {
+				return nil
+			}
+			return runError(runConfigFlow())
 		},
-		RunE: func(c *cobra.Command, args []string) error {
-			arg0 := filepath.Base(args[0])
+		RunE: func(c *cobra.Command, args []string) (err error) {
+			defer func() { err = runError(err) }()
+
+			var arg0 string
+			if len(args) > 0 {
+				arg0 = filepath.Base(args[0])
+			}
 
 			prefixWidth := max(len("dispatch"), len(arg0))
 
-			if checkEndpoint(LocalEndpoint, time.Second) {
+			if Pollers < 1 {
+				return fmt.Errorf("invalid number of pollers: %d", Pollers)
+			}
+			if LocalMode && BridgeSession != "" {
+				return fmt.Errorf("--session cannot be used with --local")
+			}
+			pickEndpoint := LocalEndpoint == autoEndpoint
+			if pickEndpoint {
+				endpoint, err := freeEndpoint()
+				if err != nil {
+					return err
+				}
+				LocalEndpoint = endpoint
+			}
+			if err := validateEndpoint(LocalEndpoint); err != nil {
+				return err
+			}
+			// The timeout of long polls is sent to Dispatch in seconds.
+			if PollTimeout < time.Second {
+				return fmt.Errorf("invalid poll timeout: %v (must be at least 1s)", PollTimeout)
+			}
+			if ReadyTimeout < 0 {
+				return fmt.Errorf("invalid ready timeout: %v", ReadyTimeout)
+			}
+			if ShutdownTimeout < 0 {
+				return fmt.Errorf("invalid shutdown timeout: %v", ShutdownTimeout)
+			}
+			if err := validateWatchPatterns(WatchPatterns); err != nil {
+				return err
+			}
+			if Attach && len(WatchPatterns) > 0 {
+				return fmt.Errorf("--watch cannot be used with --attach")
+			}
+			policy, err := parseRestartPolicy(RestartPolicy)
+			if err != nil {
+				return err
+			}
+			if Attach && policy != restartNever {
+				return fmt.Errorf("--restart cannot be used with --attach")
+			}
+			if MaxRestarts < 0 {
+				return fmt.Errorf("invalid number of restarts: %d", MaxRestarts)
+			}
+			chaos, err := newFaultInjector(ChaosFaults, ChaosRate, ChaosFunctions, ChaosDelay)
+			if err != nil {
+				return err
+			}
+			if LocalMode && chaos != nil {
+				return fmt.Errorf("--chaos cannot be used with --local")
+			}
+			if err := validateFunctionPatterns(OnlyFunctions); err != nil {
+				return err
+			}
+			if err := validateFunctionPatterns(SkipFunctions); err != nil {
+				return err
+			}
+			if _, err := parseStatus(SkipStatus); err != nil {
+				return fmt.Errorf("invalid --skip-status: %v", err)
+			}
+			if MockPath != "" {
+				if functionMocks, err = loadMocks(MockPath); err != nil {
+					return err
+				}
+			}
+
+			// Requests to the Dispatch API and to the local application
+			// have very different latency profiles, so they use separate
+			// clients and timeouts.
+			bridgeClient := newHTTPClient(PollTimeout)
+			endpointClient, err := newEndpointClient(CallTimeout)
+			if err != nil {
+				return err
+			}
+
+			// Sign requests to the local application with an ephemeral
+			// key, if requested.
+			var signer *requestSigner
+			if SignRequests {
+				signer, err = newRequestSigner(endpointClient.Transport)
+				if err != nil {
+					return err
+				}
+				endpointClient.Transport = signer
+			}
+
+			if !Attach && checkEndpoint(LocalEndpoint, time.Second) {
 				return fmt.Errorf("cannot start local application on address that's already in use: %v", LocalEndpoint)
 			}
 
+			limiter := newConcurrencyLimiter(MaxConcurrency)
+
 			// Enable the TUI if this is an interactive session and
 			// stdout/stderr aren't redirected.
 			var tui *TUI
+			var bp *breakpoints
 			var logWriter io.Writer = os.Stderr
-			var observer FunctionCallObserver
+			var observers []FunctionCallObserver
 			if isTerminal(os.Stdin) && isTerminal(os.Stdout) && isTerminal(os.Stderr) {
-				tui = &TUI{}
+				bp = newBreakpoints()
+				tui = &TUI{limiter: limiter, breakpoints: bp}
+				if pickEndpoint {
+					tui.endpoint = endpointURL()
+				}
+				bp.onPause = tui.observePaused
 				logWriter = tui
-				observer = tui
+				observers = append(observers, tui)
 			}
 
+			// Record requests and responses to a file, if requested.
+			if RecordPath != "" {
+				f, err := os.Create(RecordPath)
+				if err != nil {
+					return fmt.Errorf("failed to create session recording: %v", err)
+				}
+				defer f.Close()
+				observers = append(observers, newSessionRecorder(f))
+			}
+			// Serve metrics about function calls, if requested.
+			var metrics *sessionMetrics
+			if MetricsAddr != "" {
+				metrics = newSessionMetrics()
+				observers = append(observers, metrics)
+
+				l, err := net.Listen("tcp", MetricsAddr)
+				if err != nil {
+					return fmt.Errorf("failed to serve metrics: %v", err)
+				}
+				mux := http.NewServeMux()
+				mux.Handle("/metrics", metrics)
+				server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+				defer server.Close()
+				go func() {
+					if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+						slog.Warn("failed to serve metrics", "error", err)
+					}
+				}()
+			}
+			// Export function calls as OpenTelemetry traces, if requested.
+			var exports []func([]byte) error
+			if TracePath != "" {
+				f, err := os.Create(TracePath)
+				if err != nil {
+					return fmt.Errorf("failed to create trace file: %v", err)
+				}
+				defer f.Close()
+				exports = append(exports, exportTraceFile(f))
+			}
+			if TraceEndpoint != "" {
+				export, err := exportTraceEndpoint(newHTTPClient(traceExportTimeout), TraceEndpoint)
+				if err != nil {
+					return err
+				}
+				exports = append(exports, export)
+			}
+			if len(exports) > 0 {
+				tracer := newTraceExporter(exports...)
+				observers = append(observers, tracer)
+				defer tracer.close()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go tracer.run(ctx)
+			}
+			observer := combineObservers(observers...)
+
 			// Add a prefix to Dispatch logs.
 			slog.SetDefault(slog.New(&slogHandler{
 				stream: &prefixLogWriter{
@@ -118,27 +463,40 @@ previous run.`, defaultEndpoint),
 				BridgeSession = randomSessionID()
 			}
 
-			if !Verbose && tui == nil {
-				dialog(`Starting Dispatch session: %v
+			if !Verbose && tui == nil && !Attach {
+				if pickEndpoint {
+					dialog(`Starting Dispatch session: %v
+Local application endpoint: %v
+
+Run 'dispatch help run' to learn about Dispatch sessions.`, BridgeSession, endpointURL())
+				} else {
+					dialog(`Starting Dispatch session: %v
 
 Run 'dispatch help run' to learn about Dispatch sessions.`, BridgeSession)
+				}
 			}
 
-			slog.Info("starting session", "session_id", BridgeSession)
+			if pickEndpoint {
+				slog.Info("starting session", "session_id", BridgeSession, "endpoint", endpointURL())
+			} else {
+				slog.Info("starting session", "session_id", BridgeSession)
+			}
 
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
 			// Execute the command, forwarding the environment and
 			// setting the necessary extra DISPATCH_* variables.
-			cmd := exec.Command(args[0], args[1:]...)
+			app := &appProcess{
+				args:   args,
+				output: logWriter,
+				prefix: []byte(appLogPrefixStyle.Render(pad(arg0, prefixWidth)) + logPrefixSeparatorStyle.Render(" | ")),
+			}
 
 			cleanup := func() {
 				if err := recover(); err != nil {
 					// Don't leave behind a dangling process if a panic occurs.
-					if cmd != nil && cmd.Process != nil {
-						_ = cmd.Process.Kill()
-					}
+					app.kill()
 					panic(err)
 				}
 			}
@@ -155,61 +513,142 @@ Run 'dispatch help run' to learn about Dispatch sessions.`, BridgeSession)
 				}()
 			}
 
-			cmd.Stdin = os.Stdin
-
-			// Pipe stdout/stderr streams through a writer that adds a prefix,
-			// so that it's easier to disambiguate Dispatch logs from the local
-			// application's logs.
-			stdout, err := cmd.StdoutPipe()
-			if err != nil {
-				return fmt.Errorf("failed to create stdout pipe: %v", err)
-			}
-			defer stdout.Close()
-
-			stderr, err := cmd.StderrPipe()
-			if err != nil {
-				return fmt.Errorf("failed to create stderr pipe: %v", err)
-			}
-			defer stderr.Close()
-
 			// Pass on environment variables to the local application.
 			// Pass on the configured API key, and set a special endpoint
 			// URL for the session. Unset the verification key, so that
 			// it doesn't conflict with the session. A verification key
 			// is not required here, since function calls are retrieved
-			// from an authenticated API endpoint.
-			cmd.Env = append(
-				withoutEnv(os.Environ(), "DISPATCH_VERIFICATION_KEY="),
-				"DISPATCH_API_KEY="+DispatchApiKey,
-				"DISPATCH_ENDPOINT_URL=bridge://"+BridgeSession,
-				"DISPATCH_ENDPOINT_ADDR="+LocalEndpoint,
-			)
-
-			// Set OS-specific process attributes.
-			cmd.SysProcAttr = &syscall.SysProcAttr{}
-			setSysProcAttr(cmd.SysProcAttr)
-
-			// Setup signal handler.
+			// from an authenticated API endpoint, unless requests are
+			// signed by the CLI.
+			var dispatchEnv []string
+			unsetEnv := []string{"DISPATCH_VERIFICATION_KEY="}
+			if !LocalMode {
+				dispatchEnv = []string{
+					"DISPATCH_API_KEY=" + DispatchApiKey,
+					"DISPATCH_ENDPOINT_URL=bridge://" + BridgeSession,
+					"DISPATCH_ENDPOINT_ADDR=" + endpointListenAddr(),
+				}
+			}
+
+			// Function calls are held until the local application is ready.
+			ready := newReadyGate()
+
+			// In local mode, calls made by the local application are sent
+			// to the in-process scheduler rather than the Dispatch API.
+			var scheduler *localScheduler
+			if LocalMode {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					return fmt.Errorf("failed to start local scheduler: %v", err)
+				}
+				scheduler = newLocalScheduler(ctx, endpointClient, observer, limiter, ready, bp)
+				backgroundGoroutine(func() { scheduler.serve(l) })
+
+				unsetEnv = append(unsetEnv, "DISPATCH_API_URL=")
+				dispatchEnv = []string{
+					"DISPATCH_API_KEY=" + localApiKey,
+					"DISPATCH_API_URL=http://" + l.Addr().String(),
+					"DISPATCH_ENDPOINT_URL=" + endpointURL(),
+					"DISPATCH_ENDPOINT_ADDR=" + endpointListenAddr(),
+				}
+			}
+			if signer != nil {
+				dispatchEnv = append(dispatchEnv, "DISPATCH_VERIFICATION_KEY="+signer.verificationKey())
+			}
+			app.env = append(withoutEnv(os.Environ(), unsetEnv...), dispatchEnv...)
+
+			// In attach mode, the application must be configured by the
+			// user instead.
+			if Attach {
+				var unset []string
+				for _, prefix := range unsetEnv {
+					if !slices.ContainsFunc(dispatchEnv, func(v string) bool { return strings.HasPrefix(v, prefix) }) {
+						unset = append(unset, strings.TrimSuffix(prefix, "="))
+					}
+				}
+				msg := fmt.Sprintf(`Starting Dispatch session: %v
+
+Start the application on %s with the
+following environment variables:
+
+	%s`, BridgeSession, endpointURL(), strings.Join(dispatchEnv, "\n\t"))
+				if len(unset) > 0 {
+					msg += fmt.Sprintf("\n\nand make sure %s is not set.", strings.Join(unset, ", "))
+				}
+				dialog("%s", msg)
+			}
+
+			// Polling stops as soon as a shutdown sequence is initiated,
+			// while in-flight function calls are drained.
+			pollCtx, stopPolling := context.WithCancel(ctx)
+			defer stopPolling()
+
+			// Wait for the in-flight function calls to complete, until the
+			// shutdown timeout expires or the drain is skipped. No new
+			// function calls are started in the meantime.
+			drain := func(skip <-chan struct{}) {
+				stopPolling()
+				if scheduler != nil {
+					scheduler.stopDispatching()
+				}
+				ready.close()
+
+				if inflight, queued := limiter.counts(); inflight+queued == 0 {
+					return
+				}
+				slog.Info("waiting for in-flight function calls to complete", "timeout", ShutdownTimeout)
+				if tui != nil {
+					tui.SetDraining(true)
+					defer tui.SetDraining(false)
+				}
+				if left := limiter.drain(ctx, ShutdownTimeout, skip); left > 0 && ctx.Err() == nil {
+					slog.Warn("abandoning in-flight function calls", "count", left)
+				}
+			}
+
+			// Setup signal handler. The first signal drains in-flight
+			// function calls before being forwarded to the local
+			// application, the second one skips the drain, and the
+			// following ones kill the local application.
 			signals := make(chan os.Signal, 2)
 			signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-			var signaled bool
+			var signaled atomic.Bool
+			interrupted := make(chan struct{})
+			startDrain := make(chan os.Signal, 1)
+			skipDrain := make(chan struct{})
 			backgroundGoroutine(func() {
+				var drainSkipped bool
 				for {
 					select {
 					case <-ctx.Done():
 						return
 					case s := <-signals:
-						if !signaled {
-							signaled = true
-						} else {
-							s = os.Kill
-						}
-						if cmd.Process != nil && cmd.Process.Pid > 0 {
-							killProcess(cmd.Process, s.(syscall.Signal))
+						switch {
+						case signaled.CompareAndSwap(false, true):
+							if ShutdownTimeout == 0 {
+								close(interrupted)
+								app.signal(s)
+								break
+							}
+							startDrain <- s
+						case ShutdownTimeout > 0 && !drainSkipped:
+							drainSkipped = true
+							close(skipDrain)
+						default:
+							app.signal(os.Kill)
 						}
 					}
 				}
 			})
+			backgroundGoroutine(func() {
+				select {
+				case <-ctx.Done():
+				case s := <-startDrain:
+					drain(skipDrain)
+					close(interrupted)
+					app.signal(s)
+				}
+			})
 
 			// Initialize the TUI.
 			if tui != nil {
@@ -235,27 +674,57 @@ Run 'dispatch help run' to learn about Dispatch sessions.`, BridgeSession)
 			// Poll for work in the background.
 			var successfulPolls int64
 
-			backgroundGoroutine(func() {
-				for ctx.Err() == nil {
+			// Notify upstream if we're unable to generate a response,
+			// either because the local application can't be contacted,
+			// is misbehaving, or a shutdown sequence has been initiated.
+			cleanupRequest := func(requestID string) {
+				ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+				defer cancel()
+				if err := deleteRequest(ctx, bridgeClient, bridgeSessionURL, requestID); err != nil {
+					slog.Debug(err.Error())
+				}
+			}
+
+			pollLoop := func(logger *slog.Logger, setState func(connectionState, error)) {
+				health := newPollerHealth(logger, setState)
+
+				for pollCtx.Err() == nil {
+					// Don't fetch requests while the local application
+					// isn't ready to handle them.
+					if !ready.wait(pollCtx) {
+						return
+					}
+
+					// Stop polling while the maximum number of concurrent
+					// requests is reached, so that requests are not fetched
+					// until they can be sent to the local application.
+					if !limiter.reserve(pollCtx) {
+						return
+					}
+
 					// Fetch a request from the API.
-					requestID, res, err := poll(ctx, httpClient, bridgeSessionURL)
+					requestID, res, err := poll(pollCtx, bridgeClient, bridgeSessionURL)
 					if err != nil {
-						if ctx.Err() != nil {
+						limiter.unreserve()
+						if pollCtx.Err() != nil {
 							return
 						}
-						slog.Warn(err.Error())
-
-						if tui != nil {
-							if _, ok := err.(authError); ok {
-								tui.SetError(err)
-							}
+						metrics.observePollError(err)
+						backoff := time.NewTimer(health.failure(time.Now(), err))
+						select {
+						case <-pollCtx.Done():
+							backoff.Stop()
+							return
+						case <-backoff.C:
 						}
-
-						time.Sleep(1 * time.Second)
 						continue
-					} else if res == nil {
+					}
+					health.success(time.Now())
+					if res == nil {
+						limiter.unreserve()
 						continue
 					}
+					limiter.claim()
 
 					atomic.AddInt64(&successfulPolls, +1)
 
@@ -264,63 +733,207 @@ Run 'dispatch help run' to learn about Dispatch sessions.`, BridgeSession)
 					wg.Add(1)
 					go func() {
 						defer wg.Done()
+						defer limiter.release()
 
-						err := invoke(ctx, httpClient, bridgeSessionURL, requestID, res, observer)
+						err := invoke(ctx, bridgeClient, endpointClient, bridgeSessionURL, requestID, res, chaos, observer, bp)
 						res.Body.Close()
 						if err != nil {
 							if ctx.Err() == nil {
 								slog.Warn(err.Error())
 							}
-
-							// Notify upstream if we're unable to generate a response,
-							// either because the local application can't be contacted,
-							// is misbehaving, or a shutdown sequence has been initiated.
-							ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
-							defer cancel()
-							if err := deleteRequest(ctx, httpClient, bridgeSessionURL, requestID); err != nil {
-								slog.Debug(err.Error())
-							}
+							cleanupRequest(requestID)
 						}
 					}()
 				}
-			})
+			}
+
+			if scheduler == nil {
+				var setState func(connectionState, error)
+				if tui != nil {
+					setState = tui.SetConnectionState
+				}
+				states := newPollerStates(Pollers, setState)
+				for i := range Pollers {
+					logger := slog.Default()
+					if Pollers > 1 {
+						logger = slog.With("poller", i)
+					}
+					backgroundGoroutine(func() { pollLoop(logger, states.reporter(i)) })
+				}
+			}
+
+			// Restart the local application when its source files change.
+			restart := make(chan string, 1)
+			if len(WatchPatterns) > 0 {
+				backgroundGoroutine(func() {
+					err := watchFiles(ctx, ".", WatchPatterns, func(path string) {
+						select {
+						case restart <- path:
+						default:
+						}
+					})
+					if err != nil {
+						slog.Warn(err.Error())
+					}
+				})
+			}
+
+			// Wait for the local application to be ready before forwarding
+			// function calls to it. The check is canceled if the local
+			// application is restarted in the meantime.
+			waitUntilAppReady := func(ctx context.Context) {
+				if ReadyTimeout == 0 {
+					ready.openUnlessCanceled(ctx)
+					return
+				}
+				// In attach mode, the application is usually started after
+				// the CLI, since it needs the session's environment.
+				timeout := ReadyTimeout
+				if Attach && !c.Flags().Changed("ready-timeout") {
+					timeout = 0
+				}
+				if tui != nil {
+					tui.SetWaitingForApplication(true)
+					defer tui.SetWaitingForApplication(false)
+				}
+				slog.Debug("waiting for local application", "endpoint", LocalEndpoint)
+				if err := ready.openWhenReady(ctx, endpointClient, ReadyPath, timeout); err != nil {
+					if ctx.Err() == nil {
+						slog.Warn(err.Error())
+					}
+					return
+				}
+				slog.Debug("local application is ready", "endpoint", LocalEndpoint)
+			}
 
 			runtime.LockOSThread()
 			defer runtime.UnlockOSThread()
 
-			if err = cmd.Start(); err != nil {
-				return fmt.Errorf("failed to start %s: %v", strings.Join(args, " "), err)
+			if Attach {
+				// There's no process to supervise, run until interrupted.
+				backgroundGoroutine(func() { waitUntilAppReady(ctx) })
+				<-interrupted
 			}
+			var restarts int
+			for !Attach {
+				started := time.Now()
+				if err := app.start(); err != nil {
+					return err
+				}
+				readyCtx, cancelReady := context.WithCancel(ctx)
+				backgroundGoroutine(func() { waitUntilAppReady(readyCtx) })
+
+				exited := make(chan error, 1)
+				go func() { exited <- app.wait() }()
+
+				select {
+				case err = <-exited:
+					cancelReady()
+				case path := <-restart:
+					cancelReady()
+					restarts = 0
+					slog.Info("restarting local application", "changed", path)
+					ready.close()
+					app.stop(exited, restartTimeout)
+					continue
+				}
+
+				if signaled.Load() {
+					break
+				}
+
+				// Restart the local application if it exited, according
+				// to the restart policy, waiting a bit longer each time
+				// it exits shortly after starting.
+				if time.Since(started) >= restartResetPeriod {
+					restarts = 0
+				}
+				if policy.shouldRestart(err) {
+					if MaxRestarts == 0 || restarts < MaxRestarts {
+						restarts++
+						backoff := restartBackoff(restarts)
+						if err != nil {
+							slog.Warn("local application exited, restarting", "error", err, "restarts", restarts, "backoff", backoff)
+						} else {
+							slog.Warn("local application exited, restarting", "restarts", restarts, "backoff", backoff)
+						}
+						ready.close()
+
+						t := time.NewTimer(backoff)
+						select {
+						case <-t.C:
+							continue
+						case path := <-restart:
+							t.Stop()
+							restarts = 0
+							slog.Info("restarting local application", "changed", path)
+							continue
+						case <-interrupted:
+							t.Stop()
+						}
+						break
+					}
+					slog.Error("local application exited too many times, giving up", "restarts", restarts)
+				}
 
-			// Add a prefix to the local application's logs.
-			appLogPrefix := []byte(appLogPrefixStyle.Render(pad(arg0, prefixWidth)) + logPrefixSeparatorStyle.Render(" | "))
-			backgroundGoroutine(func() { printPrefixedLines(logWriter, stdout, appLogPrefix) })
-			backgroundGoroutine(func() { printPrefixedLines(logWriter, stderr, appLogPrefix) })
+				if len(WatchPatterns) == 0 {
+					break
+				}
 
-			err = cmd.Wait()
-			cmd = nil
+				// In watch mode, wait for the next change rather than
+				// exiting, e.g. if the application failed to start
+				// because of a syntax error.
+				if err != nil {
+					slog.Warn("local application exited, waiting for changes", "error", err)
+				} else {
+					slog.Warn("local application exited, waiting for changes")
+				}
+				ready.close()
+				select {
+				case path := <-restart:
+					restarts = 0
+					slog.Info("restarting local application", "changed", path)
+					continue
+				case <-interrupted:
+				}
+				break
+			}
 
 			// Cancel the context and wait for all goroutines to return.
 			cancel()
 			wg.Wait()
 
+			if scheduler != nil {
+				successfulPolls = scheduler.requestCount()
+			}
+
 			// If the command was halted by a signal rather than some other error,
 			// assume that the command invocation succeeded and that the user may
-			// want to resume this session.
-			if signaled {
-				err = nil
-
-				if atomic.LoadInt64(&successfulPolls) > 0 && !Verbose {
+			// want to resume this session. The exit status of the local
+			// application is still reported, e.g. if it was terminated by
+			// the signal.
+			if signaled.Load() {
+				if atomic.LoadInt64(&successfulPolls) > 0 && !Verbose && !LocalMode {
 					dispatchArg0 := os.Args[0]
-					dialog("To resume this Dispatch session:\n\n\t%s run --session %s -- %s",
-						dispatchArg0, BridgeSession, strings.Join(args, " "))
+					if Attach {
+						dialog("To resume this Dispatch session:\n\n\t%s run --session %s --attach",
+							dispatchArg0, BridgeSession)
+					} else {
+						dialog("To resume this Dispatch session:\n\n\t%s run --session %s -- %s",
+							dispatchArg0, BridgeSession, strings.Join(args, " "))
+					}
+				}
+				if err != nil {
+					c.SilenceErrors = true
+					c.SilenceUsage = true
 				}
+				return appExitError(args, err)
 			}
 
 			if err != nil {
 				dumpLogs(logWriter)
-				return fmt.Errorf("failed to invoke command '%s': %v", strings.Join(args, " "), err)
-			} else if !signaled && successfulPolls == 0 {
+				return appExitError(args, err)
+			} else if successfulPolls == 0 {
 				dumpLogs(logWriter)
 				return fmt.Errorf("command '%s' exited unexpectedly", strings.Join(args, " "))
 			}
@@ -329,7 +942,36 @@ Run 'dispatch help run' to learn about Dispatch sessions.`, BridgeSession)
 	}
 
 	cmd.Flags().StringVarP(&BridgeSession, "session", "s", "", "Optional session to resume")
-	cmd.Flags().StringVarP(&LocalEndpoint, "endpoint", "e", defaultEndpoint, "Host:port that the local application endpoint is listening on")
+	cmd.Flags().StringVarP(&LocalEndpoint, "endpoint", "e", defaultEndpoint, "Host:port, https://host:port or unix:///path.sock that the local application endpoint is listening on")
+	cmd.Flags().StringVarP(&EndpointCAFile, "endpoint-ca", "", "", "CA certificate (PEM) used to verify an https:// endpoint")
+	cmd.Flags().BoolVarP(&EndpointInsecure, "endpoint-insecure", "", false, "Skip verification of the certificate of an https:// endpoint")
+	cmd.Flags().BoolVarP(&EndpointH2C, "endpoint-h2c", "", false, "Use HTTP/2 over cleartext (h2c) to talk to the endpoint")
+	cmd.Flags().BoolVarP(&LocalMode, "local", "", false, "Run function calls with a local scheduler instead of Dispatch")
+	cmd.Flags().StringVarP(&RecordPath, "record", "", "", "Record function call requests and responses to a file")
+	cmd.Flags().IntVarP(&MaxConcurrency, "max-concurrency", "", 0, "Maximum number of concurrent requests to the local application (0 = unbounded)")
+	cmd.Flags().IntVarP(&Pollers, "pollers", "", 1, "Number of concurrent loops polling Dispatch for function calls")
+	cmd.Flags().DurationVarP(&PollTimeout, "poll-timeout", "", defaultPollTimeout, "Timeout for requests to Dispatch, including long polls")
+	cmd.Flags().DurationVarP(&CallTimeout, "call-timeout", "", defaultCallTimeout, "Timeout for requests to the local application (0 = no timeout)")
+	cmd.Flags().DurationVarP(&ReadyTimeout, "ready-timeout", "", defaultReadyTimeout, "Time to wait for the local application to be ready (0 = don't wait)")
+	cmd.Flags().StringVarP(&ReadyPath, "ready-path", "", "", "HTTP path to probe to check that the local application is ready")
+	cmd.Flags().StringArrayVarP(&WatchPatterns, "watch", "", nil, "Restart the local application when files matching the pattern change (can be repeated)")
+	cmd.Flags().BoolVarP(&Attach, "attach", "", false, "Forward function calls to an application that is already running, instead of running a command")
+	cmd.Flags().BoolVarP(&SignRequests, "sign-requests", "", false, "Sign requests to the local application with an ephemeral verification key")
+	cmd.Flags().DurationVarP(&ShutdownTimeout, "shutdown-timeout", "", defaultShutdownTimeout, "Time to wait for in-flight function calls to complete on shutdown")
+	cmd.Flags().StringVarP(&RestartPolicy, "restart", "", string(restartNever), "Restart the local application when it exits (no, on-failure or always)")
+	cmd.Flags().IntVarP(&MaxRestarts, "max-restarts", "", defaultMaxRestarts, "Maximum number of consecutive restarts of the local application (0 = unlimited)")
+	cmd.Flags().StringSliceVarP(&ChaosFaults, "chaos", "", nil, "Inject faults in function calls: drop, delay, error, unavailable or cut (can be repeated)")
+	cmd.Flags().Float64VarP(&ChaosRate, "chaos-rate", "", defaultChaosRate, "Percentage of function calls in which faults are injected")
+	cmd.Flags().StringArrayVarP(&ChaosFunctions, "chaos-function", "", nil, "Only inject faults in calls to this function (can be repeated)")
+	cmd.Flags().DurationVarP(&ChaosDelay, "chaos-delay", "", defaultChaosDelay, "Delay of requests when injecting the delay fault")
+	cmd.Flags().StringArrayVarP(&OnlyFunctions, "only", "", nil, "Only forward calls to functions matching the pattern (can be repeated)")
+	cmd.Flags().StringArrayVarP(&SkipFunctions, "skip", "", nil, "Don't forward calls to functions matching the pattern (can be repeated)")
+	cmd.Flags().StringVarP(&SkipStatus, "skip-status", "", defaultSkipStatus, "Status of the responses to function calls that are not forwarded")
+	cmd.Flags().StringVarP(&MockPath, "mock", "", "", "TOML or JSON file with canned responses of functions to stub")
+	cmd.Flags().StringVarP(&MetricsAddr, "metrics-addr", "", "", "Address to serve Prometheus metrics on, at the /metrics path")
+	cmd.Flags().StringVarP(&HookCommand, "hook", "", "", "Command to run for each function call, which can veto, modify or annotate the call")
+	cmd.Flags().StringVarP(&TraceEndpoint, "trace-endpoint", "", "", "URL of an OTLP/HTTP collector to export function calls to as traces")
+	cmd.Flags().StringVarP(&TracePath, "trace-file", "", "", "File to export function calls to as traces, in the OTLP/JSON format")
 	cmd.Flags().BoolVarP(&Verbose, "verbose", "", false, "Enable verbose logging")
 
 	return cmd
@@ -351,14 +993,14 @@ func poll(ctx context.Context, client *http.Client, url string) (string, *http.R
 		panic(err)
 	}
 	req.Header.Add("Authorization", "Bearer "+DispatchApiKey)
-	req.Header.Add("Request-Timeout", strconv.FormatInt(int64(pollTimeout.Seconds()), 10))
+	req.Header.Add("Request-Timeout", strconv.FormatInt(int64(PollTimeout.Seconds()), 10))
 	if DispatchBridgeHostHeader != "" {
 		req.Host = DispatchBridgeHostHeader
 	}
 
 	res, err := client.Do(req)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to contact Dispatch API (%s): %v", DispatchBridgeUrl, err)
+		return "", nil, fmt.Errorf("failed to contact Dispatch API (%s): %w", DispatchBridgeUrl, err)
 	}
 	if res.StatusCode != http.StatusOK {
 		res.Body.Close()
@@ -372,7 +1014,7 @@ func poll(ctx context.Context, client *http.Client, url string) (string, *http.R
 			// caller try again.
 			return "", nil, nil
 		default:
-			return "", nil, fmt.Errorf("failed to contact Dispatch API (%s): response code %d", DispatchBridgeUrl, res.StatusCode)
+			return "", nil, pollStatusError{statusCode: res.StatusCode}
 		}
 	}
 
@@ -402,7 +1044,34 @@ type FunctionCallObserver interface {
 	ObserveResponse(time.Time, *sdkv1.RunRequest, error, *http.Response, *sdkv1.RunResponse)
 }
 
-func invoke(ctx context.Context, client *http.Client, url, requestID string, bridgeGetRes *http.Response, observer FunctionCallObserver) error {
+// combineObservers returns a FunctionCallObserver that forwards observations
+// to each of the observers, or nil if there are no observers.
+func combineObservers(observers ...FunctionCallObserver) FunctionCallObserver {
+	switch len(observers) {
+	case 0:
+		return nil
+	case 1:
+		return observers[0]
+	default:
+		return multiObserver(observers)
+	}
+}
+
+type multiObserver []FunctionCallObserver
+
+func (m multiObserver) ObserveRequest(now time.Time, req *sdkv1.RunRequest) {
+	for _, o := range m {
+		o.ObserveRequest(now, req)
+	}
+}
+
+func (m multiObserver) ObserveResponse(now time.Time, req *sdkv1.RunRequest, err error, httpRes *http.Response, res *sdkv1.RunResponse) {
+	for _, o := range m {
+		o.ObserveResponse(now, req, err, httpRes, res)
+	}
+}
+
+func invoke(ctx context.Context, bridgeClient, endpointClient *http.Client, url, requestID string, bridgeGetRes *http.Response, chaos *faultInjector, observer FunctionCallObserver, bp *breakpoints) error {
 	logger := slog.Default()
 	if Verbose {
 		logger = slog.With("request_id", requestID)
@@ -439,6 +1108,172 @@ func invoke(ctx context.Context, client *http.Client, url, requestID string, bri
 		return fmt.Errorf("invalid response from Dispatch API: %v", err)
 	}
 	logger.Debug("parsed request", "function", runRequest.Function, "dispatch_id", runRequest.DispatchId)
+
+	// The RequestURI field must be cleared for client.Do() to
+	// accept the request below.
+	endpointReq.RequestURI = ""
+
+	// Inject a fault in the function call, if requested.
+	var endpointRes *http.Response
+	injected := chaos.fault(runRequest.Function)
+	if injected != "" {
+		logger.Warn("injecting fault in function call", "function", runRequest.Function, "fault", string(injected))
+	}
+	switch injected {
+	case faultDrop:
+		// Dispatch retries the request once it times out.
+		if observer != nil {
+			now := time.Now()
+			observer.ObserveRequest(now, &runRequest)
+			observer.ObserveResponse(now, &runRequest, faultDrop, nil, nil)
+		}
+		return nil
+	case faultDelay:
+		t := time.NewTimer(chaos.delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	case faultError, faultUnavailable:
+		var runResponse *sdkv1.RunResponse
+		endpointRes, runResponse = faultResponse(injected)
+		if observer != nil {
+			now := time.Now()
+			observer.ObserveRequest(now, &runRequest)
+			observer.ObserveResponse(now, &runRequest, nil, endpointRes, runResponse)
+		}
+	}
+
+	if endpointRes == nil {
+		endpointRes, _, err = callEndpoint(ctx, endpointClient, endpointReq, &runRequest, logger, observer, bp)
+		if err != nil {
+			return err
+		}
+	}
+	endpointRes.Header.Del(syntheticHeader)
+
+	// Use io.Pipe to convert the response writer into an io.Reader.
+	pr, pw := io.Pipe()
+	go func() {
+		if injected == faultCut {
+			pw.CloseWithError(writeCutResponse(pw, endpointRes))
+			return
+		}
+		err := endpointRes.Write(pw)
+		pw.CloseWithError(err)
+	}()
+
+	logger.Debug("sending response to Dispatch")
+
+	// Send the response back to the API.
+	bridgePostReq, err := http.NewRequestWithContext(ctx, "POST", url, bufio.NewReader(pr))
+	if err != nil {
+		panic(err)
+	}
+	bridgePostReq.Header.Add("Authorization", "Bearer "+DispatchApiKey)
+	bridgePostReq.Header.Add("X-Request-ID", requestID)
+	if DispatchBridgeHostHeader != "" {
+		bridgePostReq.Host = DispatchBridgeHostHeader
+	}
+	bridgePostRes, err := bridgeClient.Do(bridgePostReq)
+	if err != nil {
+		if injected == faultCut {
+			// Dispatch retries the request once it times out, as if
+			// the connection had been cut.
+			return nil
+		}
+		return fmt.Errorf("failed to contact Dispatch API or send response: %v", err)
+	}
+	switch bridgePostRes.StatusCode {
+	case http.StatusAccepted:
+		return nil
+	case http.StatusNotFound:
+		// A 404 is expected if there's a timeout upstream that's hit
+		// before the response can be sent.
+		logger.Debug("request is no longer available", "method", "post")
+		return nil
+	default:
+		return fmt.Errorf("failed to contact Dispatch API to send response: response code %d", bridgePostRes.StatusCode)
+	}
+}
+
+// callEndpoint forwards a RunRequest to the local application endpoint.
+//
+// The http.Response that is returned has its body buffered in memory. The
+// RunResponse is nil if the local application did not generate a valid
+// response. An error is returned if the local application could not be
+// contacted, or if its response could not be read or parsed.
+//
+// Function calls are held while they're paused at one of the breakpoints,
+// which may be nil.
+func callEndpoint(ctx context.Context, client *http.Client, endpointReq *http.Request, runRequest *sdkv1.RunRequest, logger *slog.Logger, observer FunctionCallObserver, bp *breakpoints) (*http.Response, *sdkv1.RunResponse, error) {
+	// Calls to functions that are mocked or filtered out are not
+	// forwarded, and are responded to in place of the local application.
+	var synthetic *sdkv1.RunResponse
+	if mock, ok := functionMocks[runRequest.Function]; ok {
+		logger.Info("mocking function call", "function", runRequest.Function, "status", statusString(mock.Status))
+		synthetic = proto.Clone(mock).(*sdkv1.RunResponse)
+	} else if functionSkipped(runRequest.Function) {
+		status, _ := parseStatus(SkipStatus)
+		logger.Info("skipping function call", "function", runRequest.Function, "status", statusString(status))
+		synthetic = skippedResponse(status)
+	}
+	if synthetic != nil {
+		if observer != nil {
+			observer.ObserveRequest(time.Now(), runRequest)
+		}
+		return respondInPlace(runRequest, synthetic, observer)
+	}
+
+	// Hold the function call while it's paused at a breakpoint. It can
+	// then be skipped, or forwarded with an edited input, which the hook
+	// and the observers see in place of the original one.
+	action, input, err := bp.wait(ctx, runRequest, logger)
+	if err != nil {
+		if observer != nil {
+			observer.ObserveRequest(time.Now(), runRequest)
+			observer.ObserveResponse(time.Now(), runRequest, err, nil, nil)
+		}
+		return nil, nil, err
+	}
+	switch {
+	case action == breakpointSkip:
+		if observer != nil {
+			observer.ObserveRequest(time.Now(), runRequest)
+		}
+		return respondInPlace(runRequest, skippedResponse(sdkv1.Status_STATUS_PERMANENT_ERROR), observer)
+	case input != nil:
+		runRequest = proto.Clone(runRequest).(*sdkv1.RunRequest)
+		runRequest.Directive = &sdkv1.RunRequest_Input{Input: input}
+		setRequestBody(endpointReq, runRequest)
+	}
+
+	// The hook can veto the function call, annotate it, or modify its
+	// request before it's forwarded.
+	hook, err := runHook(ctx, HookCommand, runRequest, nil, logger)
+	if err != nil {
+		if observer != nil {
+			observer.ObserveRequest(time.Now(), runRequest)
+		}
+		runResponse := hookErrorResponse(err)
+		if runResponse == nil {
+			if observer != nil {
+				observer.ObserveResponse(time.Now(), runRequest, err, nil, nil)
+			}
+			return nil, nil, err
+		}
+		logger.Warn("function call not forwarded", "function", runRequest.Function, "error", err)
+		return respondInPlace(runRequest, runResponse, observer)
+	}
+	logAnnotations(logger, runRequest, hook)
+	if hook != nil && hook.request != nil {
+		logger.Info("function call modified by hook", "function", runRequest.Function)
+		runRequest = hook.request
+		setRequestBody(endpointReq, runRequest)
+	}
+
 	switch d := runRequest.Directive.(type) {
 	case *sdkv1.RunRequest_Input:
 		if Verbose {
@@ -450,25 +1285,46 @@ func invoke(ctx context.Context, client *http.Client, url, requestID string, bri
 		logger.Info("resuming function", "function", runRequest.Function)
 	}
 	if observer != nil {
-		observer.ObserveRequest(time.Now(), &runRequest)
+		observer.ObserveRequest(time.Now(), runRequest)
 	}
+	now := time.Now()
 
-	// The RequestURI field must be cleared for client.Do() to
-	// accept the request below.
-	endpointReq.RequestURI = ""
+	// Requests that have expired are not forwarded, since Dispatch would
+	// discard the response anyway. Requests that are forwarded are
+	// canceled if they're still running when they expire.
+	if runRequest.ExpirationTime != nil {
+		expirationTime := runRequest.ExpirationTime.AsTime()
+		if !now.Before(expirationTime) {
+			err := expiredError{expirationTime: expirationTime}
+			if observer != nil {
+				observer.ObserveResponse(now, runRequest, err, nil, nil)
+			}
+			return nil, nil, err
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, expirationTime)
+		defer cancel()
+		endpointReq = endpointReq.WithContext(ctx)
+	}
 
 	// Forward the request to the local application endpoint.
-	endpointReq.Host = LocalEndpoint
-	endpointReq.URL.Scheme = "http"
-	endpointReq.URL.Host = LocalEndpoint
+	endpointReq.Host = endpointHost()
+	endpointReq.URL.Scheme = endpointScheme()
+	endpointReq.URL.Host = endpointHost()
 	endpointRes, err := client.Do(endpointReq)
-	now := time.Now()
+	now = time.Now()
 	if err != nil {
-		err = fmt.Errorf("can't connect to %s: %v (check that -e,--endpoint is correct)", LocalEndpoint, tidyErr(err))
+		if expired, ok := deadlineExpired(ctx, runRequest); ok {
+			err = expired
+		} else if isTimeout(err) {
+			err = callTimeoutError{timeout: client.Timeout}
+		} else {
+			err = fmt.Errorf("can't connect to %s: %v (check that -e,--endpoint is correct)", LocalEndpoint, tidyErr(err))
+		}
 		if observer != nil {
-			observer.ObserveResponse(now, &runRequest, err, nil, nil)
+			observer.ObserveResponse(now, runRequest, err, nil, nil)
 		}
-		return err
+		return nil, nil, err
 	}
 
 	// Buffer the response body in memory.
@@ -479,25 +1335,55 @@ func invoke(ctx context.Context, client *http.Client, url, requestID string, bri
 	_, err = io.Copy(endpointResBody, endpointRes.Body)
 	endpointRes.Body.Close()
 	if err != nil {
-		err = fmt.Errorf("read error from %s: %v", LocalEndpoint, tidyErr(err))
+		if expired, ok := deadlineExpired(ctx, runRequest); ok {
+			err = expired
+		} else if isTimeout(err) {
+			err = callTimeoutError{timeout: client.Timeout}
+		} else {
+			err = fmt.Errorf("read error from %s: %v", LocalEndpoint, tidyErr(err))
+		}
 		if observer != nil {
-			observer.ObserveResponse(now, &runRequest, err, endpointRes, nil)
+			observer.ObserveResponse(now, runRequest, err, endpointRes, nil)
 		}
-		return err
+		return nil, nil, err
 	}
 	endpointRes.Body = io.NopCloser(endpointResBody)
 	endpointRes.ContentLength = int64(endpointResBody.Len())
 
 	// Parse the response body from the API.
 	if endpointRes.StatusCode == http.StatusOK && endpointRes.Header.Get("Content-Type") == "application/proto" {
-		var runResponse sdkv1.RunResponse
-		if err := proto.Unmarshal(endpointResBody.Bytes(), &runResponse); err != nil {
+		runResponse := &sdkv1.RunResponse{}
+		if err := proto.Unmarshal(endpointResBody.Bytes(), runResponse); err != nil {
 			err = fmt.Errorf("invalid response from %s: %v", LocalEndpoint, tidyErr(err))
 			if observer != nil {
-				observer.ObserveResponse(now, &runRequest, err, endpointRes, nil)
+				observer.ObserveResponse(now, runRequest, err, endpointRes, nil)
 			}
-			return err
+			return nil, nil, err
+		}
+
+		// The hook can also veto, annotate or modify the response.
+		hook, err := runHook(ctx, HookCommand, runRequest, runResponse, logger)
+		if err != nil {
+			hookResponse := hookErrorResponse(err)
+			if hookResponse == nil {
+				if expired, ok := deadlineExpired(ctx, runRequest); ok {
+					err = expired
+				}
+				if observer != nil {
+					observer.ObserveResponse(time.Now(), runRequest, err, endpointRes, nil)
+				}
+				return nil, nil, err
+			}
+			logger.Warn("function response not forwarded", "function", runRequest.Function, "error", err)
+			runResponse = hookResponse
+			endpointRes = syntheticRunResponse(runResponse)
+		} else if hook != nil && hook.response != nil {
+			logger.Info("function response modified by hook", "function", runRequest.Function)
+			runResponse = hook.response
+			endpointRes = syntheticRunResponse(runResponse)
 		}
+		logAnnotations(logger, runRequest, hook)
+
 		switch runResponse.Status {
 		case sdkv1.Status_STATUS_OK:
 			switch d := runResponse.Directive.(type) {
@@ -517,50 +1403,55 @@ func invoke(ctx context.Context, client *http.Client, url, requestID string, bri
 			logger.Warn("function call failed", "function", runRequest.Function, "status", statusString(runResponse.Status), "error_type", err.GetType(), "error_message", err.GetMessage())
 		}
 		if observer != nil {
-			observer.ObserveResponse(now, &runRequest, nil, endpointRes, &runResponse)
-		}
-	} else {
-		// The response might indicate some other issue, e.g. it could be a 404 if the function can't be found
-		logger.Warn("function call failed", "function", runRequest.Function, "http_status", endpointRes.StatusCode)
-		if observer != nil {
-			observer.ObserveResponse(now, &runRequest, nil, endpointRes, nil)
+			observer.ObserveResponse(now, runRequest, nil, endpointRes, runResponse)
 		}
+		return endpointRes, runResponse, nil
 	}
 
-	// Use io.Pipe to convert the response writer into an io.Reader.
-	pr, pw := io.Pipe()
-	go func() {
-		err := endpointRes.Write(pw)
-		pw.CloseWithError(err)
-	}()
+	// The response might indicate some other issue, e.g. it could be a 404 if the function can't be found
+	logger.Warn("function call failed", "function", runRequest.Function, "http_status", endpointRes.StatusCode)
+	if observer != nil {
+		observer.ObserveResponse(now, runRequest, nil, endpointRes, nil)
+	}
+	return endpointRes, nil, nil
+}
 
-	logger.Debug("sending response to Dispatch")
+// appExitError returns the error of the run command after the local
+// application exited with the error returned by wait. The error carries the
+// exit status of the application, so that scripts wrapping the command can
+// act on it.
+func appExitError(args []string, err error) error {
+	if err == nil {
+		return nil
+	}
+	failed := fmt.Errorf("failed to invoke command '%s': %v", strings.Join(args, " "), err)
+	if code, ok := processExitCode(err); ok {
+		return &exitError{code: code, err: failed}
+	}
+	return runError(failed)
+}
 
-	// Send the response back to the API.
-	bridgePostReq, err := http.NewRequestWithContext(ctx, "POST", url, bufio.NewReader(pr))
+// setRequestBody replaces the body of the request to the local application.
+func setRequestBody(endpointReq *http.Request, runRequest *sdkv1.RunRequest) {
+	body, err := proto.Marshal(runRequest)
 	if err != nil {
 		panic(err)
 	}
-	bridgePostReq.Header.Add("Authorization", "Bearer "+DispatchApiKey)
-	bridgePostReq.Header.Add("X-Request-ID", requestID)
-	if DispatchBridgeHostHeader != "" {
-		bridgePostReq.Host = DispatchBridgeHostHeader
-	}
-	bridgePostRes, err := client.Do(bridgePostReq)
-	if err != nil {
-		return fmt.Errorf("failed to contact Dispatch API or send response: %v", err)
+	endpointReq.Body = io.NopCloser(bytes.NewReader(body))
+	endpointReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
 	}
-	switch bridgePostRes.StatusCode {
-	case http.StatusAccepted:
-		return nil
-	case http.StatusNotFound:
-		// A 404 is expected if there's a timeout upstream that's hit
-		// before the response can be sent.
-		logger.Debug("request is no longer available", "method", "post")
-		return nil
-	default:
-		return fmt.Errorf("failed to contact Dispatch API to send response: response code %d", bridgePostRes.StatusCode)
+	endpointReq.ContentLength = int64(len(body))
+}
+
+// respondInPlace returns a response generated by the CLI in place of the
+// local application.
+func respondInPlace(runRequest *sdkv1.RunRequest, runResponse *sdkv1.RunResponse, observer FunctionCallObserver) (*http.Response, *sdkv1.RunResponse, error) {
+	endpointRes := syntheticRunResponse(runResponse)
+	if observer != nil {
+		observer.ObserveResponse(time.Now(), runRequest, nil, endpointRes, runResponse)
 	}
+	return endpointRes, runResponse, nil
 }
 
 func deleteRequest(ctx context.Context, client *http.Client, url, requestID string) error {
@@ -595,7 +1486,8 @@ func deleteRequest(ctx context.Context, client *http.Client, url, requestID stri
 
 func checkEndpoint(addr string, timeout time.Duration) bool {
 	slog.Debug("checking endpoint", "addr", addr)
-	conn, err := net.DialTimeout("tcp", addr, timeout)
+	network, address := endpointAddr(addr)
+	conn, err := net.DialTimeout(network, address, timeout)
 	if err != nil {
 		slog.Debug("endpoint could not be contacted", "addr", addr, "err", err)
 		return false
@@ -651,6 +1543,46 @@ var (
 	errConnectionRefused = errors.New("connection refused")
 )
 
+// callTimeoutError is returned when the local application does not respond
+// within the call timeout.
+type callTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e callTimeoutError) Error() string {
+	return fmt.Sprintf("call timed out after %v (see --call-timeout)", e.timeout)
+}
+
+// expiredError is returned when a function call expires before the local
+// application has responded, or before the request could be sent to it.
+type expiredError struct {
+	expirationTime time.Time
+	// running is true if the local application was still processing the
+	// request when it expired.
+	running bool
+}
+
+func (e expiredError) Error() string {
+	if e.running {
+		return "Expired while running"
+	}
+	return "Expired before being sent"
+}
+
+// deadlineExpired returns an expiredError if ctx was canceled because the
+// expiration time of the RunRequest was reached.
+func deadlineExpired(ctx context.Context, runRequest *sdkv1.RunRequest) (expiredError, bool) {
+	if runRequest.ExpirationTime == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return expiredError{}, false
+	}
+	return expiredError{expirationTime: runRequest.ExpirationTime.AsTime(), running: true}, true
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func tidyErr(err error) error {
 	var errno syscall.Errno
 	if errors.As(err, &errno) {
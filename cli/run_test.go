@@ -1,19 +1,30 @@
 package cli
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	tea "github.com/charmbracelet/bubbletea"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var dispatchBinary = filepath.Join("../build", runtime.GOOS, runtime.GOARCH, "dispatch")
@@ -35,6 +46,36 @@ func TestRunCommand(t *testing.T) {
 		assert.Regexp(t, "Error: failed to load env file from .+"+path+": open non-existent\\.env: "+errMsg, buff.String())
 	})
 
+	t.Run("Run with a command in attach mode", func(t *testing.T) {
+		t.Parallel()
+
+		buff, err := execRunCommand(&[]string{}, "run", "--attach", "--", "echo", "hello")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.Contains(t, buff.String(), "Error: a command cannot be specified with --attach")
+	})
+
+	t.Run("Run with a session in local mode", func(t *testing.T) {
+		t.Parallel()
+
+		buff, err := execRunCommand(&[]string{}, "run", "--local", "--session", "abc", "--", "echo", "hello")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.Contains(t, buff.String(), "Error: --session cannot be used with --local")
+	})
+
+	t.Run("Run with poll timeout shorter than a second", func(t *testing.T) {
+		t.Parallel()
+
+		buff, err := execRunCommand(&[]string{}, "run", "--poll-timeout", "500ms", "--", "echo", "hello")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.Contains(t, buff.String(), "Error: invalid poll timeout: 500ms (must be at least 1s)")
+	})
+
 	if runtime.GOOS != "windows" {
 		t.Run("Run with env file", func(t *testing.T) {
 			t.Parallel()
@@ -129,6 +170,255 @@ func TestRunCommand(t *testing.T) {
 	}
 }
 
+func TestRunCommandExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exit codes of shell commands are not supported on Windows")
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "application exit status", args: []string{"run", "--local", "--", "sh", "-c", "exit 3"}, code: 3},
+		{name: "application not found", args: []string{"run", "--local", "--", "./non-existent"}, code: exitCodeNotFound},
+		{name: "application exited unexpectedly", args: []string{"run", "--local", "--", "true"}, code: exitCodeError},
+		{name: "invalid option", args: []string{"run", "--pollers", "0", "--", "true"}, code: exitCodeError},
+		{name: "usage error", args: []string{"run", "--non-existent-flag"}, code: 1},
+		{name: "other command", args: []string{"replay", "non-existent.jsonl"}, code: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err := exec.CommandContext(ctx, dispatchBinary, test.args...).Run()
+			var exitErr *exec.ExitError
+			if assert.ErrorAs(t, err, &exitErr) {
+				assert.Equal(t, test.code, exitErr.ExitCode())
+			}
+		})
+	}
+}
+
+func TestRunCommandDrain(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals are not supported on Windows")
+	}
+
+	// The root function polls a child call once it's released. The
+	// session is attached to the test server.
+	var childCalls int64
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+
+		res := &sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK, Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{}}}
+		if req.Function == "child" {
+			atomic.AddInt64(&childCalls, 1)
+		} else {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			res.Directive = &sdkv1.RunResponse_Poll{Poll: &sdkv1.Poll{
+				Calls:      []*sdkv1.Call{{CorrelationId: 1, Function: "child"}},
+				MinResults: 1,
+			}}
+		}
+		b, _ := proto.Marshal(res)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	}))
+	defer app.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd, url, exited := startAttachedSession(ctx, t, "--local", "-e", app.Listener.Addr().String(), "--ready-timeout", "0", "--shutdown-timeout", "5s")
+	dispatchCall(t, url, "root")
+	select {
+	case <-started:
+	case <-ctx.Done():
+		t.Fatal("function call was not sent")
+	}
+
+	// The session only ends once the in-flight call has completed, and
+	// the call it makes is not sent.
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("command exited before the function call completed: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	release <- struct{}{}
+
+	select {
+	case err := <-exited:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("command did not exit after the drain")
+	}
+	assert.Zero(t, atomic.LoadInt64(&childCalls))
+}
+
+func TestRunCommandAttachReady(t *testing.T) {
+	// The local application handles function calls right away, but only
+	// reports being ready once the test says so.
+	var ready atomic.Bool
+	calls := make(chan string, 1)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ready" {
+			if !ready.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req sdkv1.RunRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+		calls <- req.Function
+		b, _ := proto.Marshal(&sdkv1.RunResponse{Status: sdkv1.Status_STATUS_OK, Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{}}})
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(b)
+	}))
+	defer app.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd, url, exited := startAttachedSession(ctx, t, "--local", "-e", app.Listener.Addr().String(), "--ready-path", "/ready")
+	defer func() {
+		_ = cmd.Process.Kill()
+		<-exited
+	}()
+
+	// Function calls are held until the application is ready.
+	dispatchCall(t, url, "work")
+	select {
+	case function := <-calls:
+		t.Fatalf("function call %q was sent before the application was ready", function)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	ready.Store(true)
+	select {
+	case function := <-calls:
+		assert.Equal(t, "work", function)
+	case <-ctx.Done():
+		t.Fatal("function call was not sent once the application was ready")
+	}
+}
+
+// startAttachedSession runs the CLI in attach mode with the arguments, and
+// returns the command, the URL of the API to dispatch calls to in local
+// mode, and a channel receiving the result of the command once it exits.
+func startAttachedSession(ctx context.Context, t *testing.T, args ...string) (*exec.Cmd, string, <-chan error) {
+	args = append([]string{"run", "--api-key", "00000000", "--attach"}, args...)
+	cmd := exec.CommandContext(ctx, dispatchBinary, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The API URL to use is printed when the session starts.
+	apiURL := make(chan string, 1)
+	stdoutClosed := make(chan struct{})
+	go func() {
+		defer close(stdoutClosed)
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			if _, url, ok := strings.Cut(s.Text(), "DISPATCH_API_URL="); ok {
+				apiURL <- strings.Fields(url)[0]
+				break
+			}
+		}
+		_, _ = io.Copy(io.Discard, stdout)
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		<-stdoutClosed
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case url := <-apiURL:
+		return cmd, url, exited
+	case <-ctx.Done():
+		t.Fatal("session did not start")
+		return nil, "", nil
+	}
+}
+
+// dispatchCall dispatches a call to the function through the API of a
+// session in local mode.
+func dispatchCall(t *testing.T, url, function string) {
+	b, _ := proto.Marshal(&sdkv1.DispatchRequest{Calls: []*sdkv1.Call{{Function: function}}})
+	res, err := http.Post(url+dispatchPath, "application/proto", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestRunCommandPollers(t *testing.T) {
+	// The bridge holds long polls for a while, as if no function calls
+	// were available.
+	var polls, maxPolls int64
+	bridge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&polls, 1)
+		defer atomic.AddInt64(&polls, -1)
+		for {
+			max := atomic.LoadInt64(&maxPolls)
+			if n <= max || atomic.CompareAndSwapInt64(&maxPolls, max, n) {
+				break
+			}
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}))
+	defer bridge.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, dispatchBinary, "run", "--api-key", "00000000", "--attach",
+		"-e", "127.0.0.1:0", "--ready-timeout", "0", "--pollers", "3")
+	cmd.Env = append(os.Environ(), "DISPATCH_BRIDGE_URL="+bridge.URL)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	// Each poller holds a long poll open concurrently.
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&maxPolls) >= 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Never(t, func() bool { return atomic.LoadInt64(&maxPolls) > 3 }, 100*time.Millisecond, 10*time.Millisecond)
+}
+
 func execRunCommand(envVars *[]string, arg ...string) (bytes.Buffer, error) {
 	// Create a context with a timeout to ensure the process doesn't run indefinitely
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -198,3 +488,117 @@ func findEnvVariableInLogs(buf *bytes.Buffer) (string, bool) {
 	}
 	return result, found
 }
+
+func TestCallEndpointExpiration(t *testing.T) {
+	var calls int64
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		<-r.Context().Done()
+	}))
+	defer app.Close()
+
+	oldEndpoint := LocalEndpoint
+	LocalEndpoint = app.Listener.Addr().String()
+	defer func() { LocalEndpoint = oldEndpoint }()
+	logger := slog.New(&slogHandler{stream: io.Discard})
+	ctx := context.Background()
+
+	t.Run("Request that has expired is not sent", func(t *testing.T) {
+		tui := &TUI{}
+		req := &sdkv1.RunRequest{
+			DispatchId:     "1",
+			RootDispatchId: "1",
+			Function:       "a",
+			ExpirationTime: timestamppb.New(time.Now().Add(-time.Second)),
+		}
+		_, _, err := callEndpoint(ctx, http.DefaultClient, newEndpointRequest(ctx, nil), req, logger, tui, nil)
+		assert.ErrorAs(t, err, &expiredError{})
+		assert.Equal(t, int64(0), atomic.LoadInt64(&calls))
+
+		n := tui.calls["1"]
+		assert.True(t, n.done)
+		assert.Equal(t, "Expired before being sent", n.lastError.Error())
+	})
+
+	t.Run("Request is canceled when it expires", func(t *testing.T) {
+		tui := &TUI{}
+		req := &sdkv1.RunRequest{
+			DispatchId:     "2",
+			RootDispatchId: "2",
+			Function:       "b",
+			ExpirationTime: timestamppb.New(time.Now().Add(100 * time.Millisecond)),
+		}
+		_, _, err := callEndpoint(ctx, http.DefaultClient, newEndpointRequest(ctx, nil), req, logger, tui, nil)
+		var expired expiredError
+		assert.ErrorAs(t, err, &expired)
+		assert.True(t, expired.running)
+		assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+		n := tui.calls["2"]
+		assert.True(t, n.done)
+		assert.Equal(t, "Expired while running", n.lastError.Error())
+	})
+
+	t.Run("Call that expires while waiting to be retried is shown as expired", func(t *testing.T) {
+		tui := &TUI{}
+		tui.Init()
+		tui.Update(tea.WindowSizeMsg{Width: 120, Height: 40})
+
+		now := time.Now()
+		req := &sdkv1.RunRequest{
+			DispatchId:     "3",
+			RootDispatchId: "3",
+			Function:       "c",
+			ExpirationTime: timestamppb.New(now.Add(100 * time.Millisecond)),
+		}
+		tui.ObserveRequest(now, req)
+		tui.ObserveResponse(now, req, nil, nil, &sdkv1.RunResponse{
+			Status:    sdkv1.Status_STATUS_TEMPORARY_ERROR,
+			Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{}},
+		})
+
+		tui.Update(tickMsg{})
+		n := tui.calls["3"]
+		_, _, status := n.status()
+		assert.Equal(t, "Temporary error", status)
+
+		assert.Eventually(t, func() bool {
+			tui.Update(tickMsg{})
+			return tui.calls["3"].done
+		}, time.Second, 10*time.Millisecond)
+
+		n = tui.calls["3"]
+		_, icon, status := n.status()
+		assert.Equal(t, "Expired while waiting to be retried", status)
+		assert.Equal(t, failureIcon, icon)
+		assert.Equal(t, req.ExpirationTime.AsTime(), n.doneTime)
+	})
+}
+
+func TestCallEndpointTimeout(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer app.Close()
+
+	oldEndpoint := LocalEndpoint
+	LocalEndpoint = app.Listener.Addr().String()
+	defer func() { LocalEndpoint = oldEndpoint }()
+
+	logger := slog.New(&slogHandler{stream: io.Discard})
+	ctx := context.Background()
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+
+	tui := &TUI{}
+	req := &sdkv1.RunRequest{DispatchId: "1", RootDispatchId: "1", Function: "slow"}
+	_, _, err := callEndpoint(ctx, client, newEndpointRequest(ctx, nil), req, logger, tui, nil)
+	assert.ErrorAs(t, err, &callTimeoutError{})
+
+	// Timeouts are reported as a status, and the call is retried.
+	n := tui.calls["1"]
+	assert.False(t, n.done)
+	assert.Nil(t, n.lastError)
+	assert.Equal(t, sdkv1.Status_STATUS_TIMEOUT, n.lastStatus)
+	_, _, status := n.status()
+	assert.Equal(t, "Timeout", status)
+}
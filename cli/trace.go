@@ -0,0 +1,429 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+)
+
+var (
+	TraceEndpoint string
+	TracePath     string
+)
+
+const (
+	traceFlushInterval = 5 * time.Second
+	traceExportTimeout = 10 * time.Second
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	statusCodeOK     = 1
+	statusCodeError  = 2
+)
+
+// traceExporter is a FunctionCallObserver that maps function calls to
+// OpenTelemetry spans, and exports them in the OTLP/JSON format.
+//
+// Each function call is a span. Spans of the same workflow share a trace
+// ID derived from the root dispatch ID, and the span of a function call is
+// the child of the span of the function that called it. Span IDs are
+// derived from dispatch IDs, so that spans can be linked to their parent
+// even if the parent was observed in a previous session. Each round-trip
+// to the local application is recorded as an event of the span.
+type traceExporter struct {
+	mu    sync.Mutex
+	spans map[DispatchID]*callSpan
+	ended []*callSpan
+
+	flushMu sync.Mutex
+	exports []func([]byte) error
+}
+
+type callSpan struct {
+	traceID      string
+	spanID       string
+	parentSpanID string
+	id           DispatchID
+	function     string
+	start        time.Time
+	end          time.Time
+	attempts     int
+	status       sdkv1.Status
+	err          string
+	incomplete   bool
+	events       []spanEvent
+	// requests holds the time at which in-flight requests were observed.
+	requests map[*sdkv1.RunRequest]time.Time
+}
+
+type spanEvent struct {
+	time       time.Time
+	name       string
+	attributes []otlpKeyValue
+}
+
+func newTraceExporter(exports ...func([]byte) error) *traceExporter {
+	return &traceExporter{
+		spans:   map[DispatchID]*callSpan{},
+		exports: exports,
+	}
+}
+
+// exportTraceFile returns an export function that appends OTLP/JSON
+// documents to w, one per line, in the format of the OpenTelemetry
+// collector file exporter.
+func exportTraceFile(w io.Writer) func([]byte) error {
+	return func(b []byte) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	}
+}
+
+// exportTraceEndpoint returns an export function that sends OTLP/JSON
+// documents to a collector over HTTP. The /v1/traces path is added to the
+// endpoint URL if it doesn't have one.
+func exportTraceEndpoint(client *http.Client, endpoint string) (func([]byte) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid trace endpoint: %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	endpoint = u.String()
+
+	return func(b []byte) error {
+		ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		_, _ = io.Copy(io.Discard, res.Body)
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("response code %d", res.StatusCode)
+		}
+		return nil
+	}, nil
+}
+
+func (e *traceExporter) ObserveRequest(now time.Time, req *sdkv1.RunRequest) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := DispatchID(req.DispatchId)
+	s, ok := e.spans[id]
+	if !ok {
+		rootID := req.RootDispatchId
+		if rootID == "" {
+			rootID = req.DispatchId
+		}
+		s = &callSpan{
+			traceID:  traceID(rootID),
+			spanID:   spanID(req.DispatchId),
+			id:       id,
+			function: req.Function,
+			start:    now,
+			requests: map[*sdkv1.RunRequest]time.Time{},
+		}
+		if req.ParentDispatchId != "" && req.ParentDispatchId != req.DispatchId {
+			s.parentSpanID = spanID(req.ParentDispatchId)
+		}
+		if req.CreationTime != nil {
+			s.start = req.CreationTime.AsTime()
+		}
+		e.spans[id] = s
+	}
+	if _, ok := req.Directive.(*sdkv1.RunRequest_Input); ok {
+		s.attempts++
+	}
+	s.requests[req] = now
+}
+
+func (e *traceExporter) ObserveResponse(now time.Time, req *sdkv1.RunRequest, err error, httpRes *http.Response, res *sdkv1.RunResponse) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := DispatchID(req.DispatchId)
+	s, ok := e.spans[id]
+	if !ok {
+		return
+	}
+	requestTime, ok := s.requests[req]
+	if !ok {
+		return
+	}
+	delete(s.requests, req)
+
+	event := spanEvent{time: now, name: "resume"}
+	if _, ok := req.Directive.(*sdkv1.RunRequest_Input); ok {
+		event.name = "call"
+	}
+	event.attributes = append(event.attributes,
+		stringAttribute("dispatch.function", req.Function),
+		intAttribute("dispatch.latency_ms", now.Sub(requestTime).Milliseconds()))
+
+	var done bool
+	switch {
+	case res != nil:
+		s.status = res.Status
+		s.err = ""
+		event.attributes = append(event.attributes, stringAttribute("dispatch.status", statusString(res.Status)))
+		switch d := res.Directive.(type) {
+		case *sdkv1.RunResponse_Exit:
+			if d.Exit.TailCall != nil {
+				event.attributes = append(event.attributes, stringAttribute("dispatch.tail_call", d.Exit.TailCall.Function))
+				break
+			}
+			done = terminalStatus(res.Status)
+			if callErr := d.Exit.GetResult().GetError(); callErr != nil {
+				s.err = callErr.Type
+				if callErr.Message != "" {
+					s.err += ": " + callErr.Message
+				}
+				event.attributes = append(event.attributes,
+					stringAttribute("exception.type", callErr.Type),
+					stringAttribute("exception.message", callErr.Message))
+			}
+		case *sdkv1.RunResponse_Poll:
+			event.attributes = append(event.attributes, intAttribute("dispatch.calls", int64(len(d.Poll.Calls))))
+		}
+	case httpRes != nil:
+		s.err = fmt.Sprintf("unexpected HTTP status code %d", httpRes.StatusCode)
+		done = terminalHTTPStatusCode(httpRes.StatusCode)
+		event.attributes = append(event.attributes, intAttribute("http.response.status_code", int64(httpRes.StatusCode)))
+	case err != nil:
+		s.err = err.Error()
+		done = errors.As(err, &expiredError{})
+		event.attributes = append(event.attributes, stringAttribute("exception.message", err.Error()))
+	}
+	s.events = append(s.events, event)
+
+	if done {
+		s.end = now
+		delete(e.spans, id)
+		e.ended = append(e.ended, s)
+	}
+}
+
+// run exports ended spans periodically, until the context is canceled.
+func (e *traceExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.flush(false)
+		}
+	}
+}
+
+// close exports the remaining spans. The spans of function calls that
+// haven't completed yet end at this time, and are marked as incomplete.
+func (e *traceExporter) close() {
+	e.flush(true)
+}
+
+func (e *traceExporter) flush(all bool) {
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	now := time.Now()
+	e.mu.Lock()
+	spans := e.ended
+	e.ended = nil
+	if all {
+		for id, s := range e.spans {
+			s.end = now
+			s.incomplete = true
+			spans = append(spans, s)
+			delete(e.spans, id)
+		}
+	}
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		otlpSpans[i] = s.otlp()
+	}
+	e.mu.Unlock()
+
+	if len(otlpSpans) == 0 {
+		return
+	}
+	b, err := json.Marshal(newOTLPTraces(otlpSpans))
+	if err != nil {
+		panic(err)
+	}
+	for _, export := range e.exports {
+		if err := export(b); err != nil {
+			slog.Warn("failed to export traces", "spans", len(otlpSpans), "error", err)
+		}
+	}
+}
+
+func (s *callSpan) otlp() otlpSpan {
+	span := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentSpanID,
+		Name:              s.function,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes: []otlpKeyValue{
+			stringAttribute("dispatch.id", string(s.id)),
+			stringAttribute("dispatch.function", s.function),
+			intAttribute("dispatch.attempts", int64(s.attempts)),
+		},
+		Status: otlpStatus{Code: statusCodeOK},
+	}
+	if s.status != sdkv1.Status_STATUS_UNSPECIFIED {
+		span.Attributes = append(span.Attributes, stringAttribute("dispatch.status", statusString(s.status)))
+	}
+	if s.incomplete {
+		span.Attributes = append(span.Attributes, boolAttribute("dispatch.incomplete", true))
+	}
+	if (s.status != sdkv1.Status_STATUS_OK && s.status != sdkv1.Status_STATUS_UNSPECIFIED) || s.err != "" {
+		span.Status = otlpStatus{Code: statusCodeError, Message: s.err}
+	}
+	for _, event := range s.events {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: unixNano(event.time),
+			Name:         event.name,
+			Attributes:   event.attributes,
+		})
+	}
+	return span
+}
+
+// traceID returns the ID of the trace of a workflow, derived from the ID of
+// its root function call.
+func traceID(rootID string) string {
+	h := sha256.Sum256([]byte(rootID))
+	return hex.EncodeToString(h[:16])
+}
+
+// spanID returns the ID of the span of a function call, derived from its
+// dispatch ID.
+func spanID(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[16:24])
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// The types below are the subset of the OTLP/JSON encoding of
+// ExportTraceServiceRequest that's used by the exporter.
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpKeyValue {
+	s := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &s}}
+}
+
+func boolAttribute(key string, value bool) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{BoolValue: &value}}
+}
+
+func newOTLPTraces(spans []otlpSpan) *otlpTraces {
+	return &otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{
+					stringAttribute("service.name", "dispatch"),
+					stringAttribute("dispatch.session_id", BridgeSession),
+				},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/dispatchrun/dispatch", Version: version()},
+				Spans: spans,
+			}},
+		}},
+	}
+}
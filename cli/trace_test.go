@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceExporter(t *testing.T) {
+	var out bytes.Buffer
+	e := newTraceExporter(exportTraceFile(&out))
+	now := time.Now()
+
+	// The root function calls a child function, which fails once before
+	// succeeding. The other function never completes.
+	root := &sdkv1.RunRequest{Function: "root", DispatchId: "1", RootDispatchId: "1", Directive: &sdkv1.RunRequest_Input{}}
+	e.ObserveRequest(now, root)
+	e.ObserveResponse(now.Add(time.Millisecond), root, nil, nil, &sdkv1.RunResponse{
+		Status:    sdkv1.Status_STATUS_OK,
+		Directive: &sdkv1.RunResponse_Poll{Poll: &sdkv1.Poll{Calls: []*sdkv1.Call{{Function: "child"}}}},
+	})
+
+	for i, status := range []sdkv1.Status{sdkv1.Status_STATUS_TEMPORARY_ERROR, sdkv1.Status_STATUS_OK} {
+		child := &sdkv1.RunRequest{Function: "child", DispatchId: "2", ParentDispatchId: "1", RootDispatchId: "1", Directive: &sdkv1.RunRequest_Input{}}
+		e.ObserveRequest(now.Add(time.Duration(i+2)*time.Millisecond), child)
+		e.ObserveResponse(now.Add(time.Duration(i+3)*time.Millisecond), child, nil, nil, &sdkv1.RunResponse{
+			Status:    status,
+			Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{}},
+		})
+	}
+
+	resume := &sdkv1.RunRequest{Function: "root", DispatchId: "1", RootDispatchId: "1", Directive: &sdkv1.RunRequest_PollResult{}}
+	e.ObserveRequest(now.Add(5*time.Millisecond), resume)
+	e.ObserveResponse(now.Add(6*time.Millisecond), resume, nil, nil, &sdkv1.RunResponse{
+		Status: sdkv1.Status_STATUS_PERMANENT_ERROR,
+		Directive: &sdkv1.RunResponse_Exit{Exit: &sdkv1.Exit{Result: &sdkv1.CallResult{
+			Error: &sdkv1.Error{Type: "ValueError", Message: "oops"},
+		}}},
+	})
+
+	other := &sdkv1.RunRequest{Function: "other", DispatchId: "3", RootDispatchId: "3", Directive: &sdkv1.RunRequest_Input{}}
+	e.ObserveRequest(now, other)
+
+	// Only spans of completed function calls are exported before the
+	// exporter is closed.
+	e.flush(false)
+	spans := decodeSpans(t, &out)
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	childSpan, rootSpan := spans[0], spans[1]
+
+	assert.Equal(t, "child", childSpan.Name)
+	assert.Equal(t, traceID("1"), childSpan.TraceID)
+	assert.Equal(t, spanID("2"), childSpan.SpanID)
+	assert.Equal(t, spanID("1"), childSpan.ParentSpanID)
+	assert.Equal(t, statusCodeOK, childSpan.Status.Code)
+	assert.Len(t, childSpan.Events, 2)
+	assert.Contains(t, childSpan.Attributes, intAttribute("dispatch.attempts", 2))
+
+	assert.Equal(t, "root", rootSpan.Name)
+	assert.Equal(t, traceID("1"), rootSpan.TraceID)
+	assert.Empty(t, rootSpan.ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: statusCodeError, Message: "ValueError: oops"}, rootSpan.Status)
+	if assert.Len(t, rootSpan.Events, 2) {
+		assert.Equal(t, "call", rootSpan.Events[0].Name)
+		assert.Equal(t, "resume", rootSpan.Events[1].Name)
+	}
+	assert.Contains(t, rootSpan.Attributes, intAttribute("dispatch.attempts", 1))
+
+	e.close()
+	spans = decodeSpans(t, &out)
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "other", spans[0].Name)
+		assert.Equal(t, traceID("3"), spans[0].TraceID)
+		assert.Contains(t, spans[0].Attributes, boolAttribute("dispatch.incomplete", true))
+	}
+
+	e.close()
+	assert.Zero(t, out.Len())
+}
+
+func TestExportTraceEndpoint(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		requests <- r
+	}))
+	defer server.Close()
+
+	export, err := exportTraceEndpoint(http.DefaultClient, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, export([]byte(`{}`)))
+	r := <-requests
+	assert.Equal(t, "/v1/traces", r.URL.Path)
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+	_, err = exportTraceEndpoint(http.DefaultClient, "localhost:4318")
+	assert.Error(t, err)
+}
+
+func decodeSpans(t *testing.T, r io.Reader) []otlpSpan {
+	var spans []otlpSpan
+	d := json.NewDecoder(r)
+	for d.More() {
+		var traces otlpTraces
+		if err := d.Decode(&traces); err != nil {
+			t.Fatal(err)
+		}
+		for _, rs := range traces.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
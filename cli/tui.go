@@ -47,6 +47,7 @@ var (
 	// Styles for function names and statuses in the table.
 	pendingStyle   = lipgloss.NewStyle().Foreground(grayColor)
 	suspendedStyle = lipgloss.NewStyle().Foreground(grayColor)
+	pausedStyle    = lipgloss.NewStyle().Foreground(magentaColor)
 	retryStyle     = lipgloss.NewStyle().Foreground(yellowColor)
 	errorStyle     = lipgloss.NewStyle().Foreground(redColor)
 	okStyle        = lipgloss.NewStyle().Foreground(greenColor)
@@ -89,8 +90,39 @@ type TUI struct {
 	windowHeight     int
 	selected         *DispatchID
 
+	// Breakpoints set from the TUI, and the text input used to set them,
+	// or to edit the input of a function call paused at a breakpoint.
+	breakpoints    *breakpoints
+	input          textinput.Model
+	inputErr       error
+	breakpointMode bool
+	editMode       bool
+	breakpointHelp string
+	pausedHelp     string
+	editHelp       string
+
 	err error
 
+	// State of the connection to the Dispatch API, and the error that
+	// caused the last state change, if any.
+	connectionState connectionState
+	connectionErr   error
+
+	// True while waiting for the local application to be ready.
+	waitingForApplication bool
+
+	// True while waiting for in-flight function calls to complete
+	// before shutting down.
+	draining bool
+
+	// Limiter for requests sent to the local application, used to
+	// report the number of concurrent and queued requests.
+	limiter *concurrencyLimiter
+
+	// Endpoint of the local application, shown below the logo when it
+	// was picked by the CLI (--endpoint auto).
+	endpoint string
+
 	mu sync.Mutex
 }
 
@@ -145,11 +177,49 @@ var (
 		key.WithHelp("↑↓", "scroll"),
 	)
 
-	logoKeyMap         = []key.Binding{showLogsTabKey, quitKey}
-	functionsTabKeyMap = []key.Binding{showLogsTabKey, selectModeKey, scrollKeys, quitKey}
-	detailTabKeyMap    = []key.Binding{showFunctionsTabKey, scrollKeys, quitKey}
+	breakpointKey = key.NewBinding(
+		key.WithKeys("b"),
+		key.WithHelp("b", "breakpoint"),
+	)
+
+	releaseKey = key.NewBinding(
+		key.WithKeys("r"),
+		key.WithHelp("r", "release"),
+	)
+
+	skipKey = key.NewBinding(
+		key.WithKeys("x"),
+		key.WithHelp("x", "skip"),
+	)
+
+	editKey = key.NewBinding(
+		key.WithKeys("e"),
+		key.WithHelp("e", "edit input"),
+	)
+
+	toggleBreakpointKeys = key.NewBinding(
+		key.WithKeys("enter"),
+		key.WithHelp("function enter", "toggle breakpoint"),
+	)
+
+	releaseEditedKeys = key.NewBinding(
+		key.WithKeys("enter"),
+		key.WithHelp("json enter", "release with input"),
+	)
+
+	cancelKey = key.NewBinding(
+		key.WithKeys("esc"),
+		key.WithHelp("esc", "cancel"),
+	)
+
+	logoKeyMap         = []key.Binding{showLogsTabKey, breakpointKey, quitKey}
+	functionsTabKeyMap = []key.Binding{showLogsTabKey, selectModeKey, breakpointKey, scrollKeys, quitKey}
+	detailTabKeyMap    = []key.Binding{showFunctionsTabKey, breakpointKey, scrollKeys, quitKey}
+	pausedKeyMap       = []key.Binding{showFunctionsTabKey, releaseKey, skipKey, editKey, breakpointKey, quitKey}
 	logsTabKeyMap      = []key.Binding{showFunctionsTabKey, tailKey, scrollKeys, quitKey}
 	selectKeyMap       = []key.Binding{selectKeys, scrollKeys, exitSelectKey}
+	breakpointKeyMap   = []key.Binding{toggleBreakpointKeys, cancelKey}
+	editKeyMap         = []key.Binding{releaseEditedKeys, cancelKey}
 )
 
 type tickMsg struct{}
@@ -173,6 +243,20 @@ func focusSelect() tea.Msg {
 	return focusSelectMsg{}
 }
 
+type focusBreakpointMsg struct{}
+
+func focusBreakpoint() tea.Msg {
+	return focusBreakpointMsg{}
+}
+
+type focusEditMsg struct{ input string }
+
+func focusEdit(input string) tea.Cmd {
+	return func() tea.Msg {
+		return focusEditMsg{input: input}
+	}
+}
+
 func (t *TUI) Init() tea.Cmd {
 	// Note that t.viewport is initialized on the first tea.WindowSizeMsg.
 	t.help = help.New()
@@ -180,6 +264,9 @@ func (t *TUI) Init() tea.Cmd {
 	t.selection = textinput.New()
 	t.selection.Focus() // input is visibile iff t.selectMode == true
 
+	t.input = textinput.New()
+	t.input.Focus() // input is visible iff t.breakpointMode or t.editMode
+
 	t.selectMode = false
 	t.tailMode = true
 
@@ -189,6 +276,9 @@ func (t *TUI) Init() tea.Cmd {
 	t.functionsTabHelp = t.help.ShortHelpView(functionsTabKeyMap)
 	t.detailTabHelp = t.help.ShortHelpView(detailTabKeyMap)
 	t.selectHelp = t.help.ShortHelpView(selectKeyMap)
+	t.breakpointHelp = t.help.ShortHelpView(breakpointKeyMap)
+	t.pausedHelp = t.help.ShortHelpView(pausedKeyMap)
+	t.editHelp = t.help.ShortHelpView(editKeyMap)
 
 	return tick()
 }
@@ -202,6 +292,7 @@ func (t *TUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tickMsg:
 		t.ticks++
+		t.expireCalls(time.Now())
 		cmds = append(cmds, tick())
 
 	case focusSelectMsg:
@@ -209,6 +300,19 @@ func (t *TUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		t.selection.SetValue("")
 		cmds = append(cmds, textinput.Blink)
 
+	case focusBreakpointMsg:
+		t.breakpointMode = true
+		t.input.Placeholder = "function name"
+		t.input.SetValue("")
+		cmds = append(cmds, textinput.Blink)
+
+	case focusEditMsg:
+		t.editMode = true
+		t.input.Placeholder = ""
+		t.input.SetValue(msg.input)
+		t.input.CursorEnd()
+		cmds = append(cmds, textinput.Blink)
+
 	case tea.WindowSizeMsg:
 		t.windowHeight = msg.Height
 		height := msg.Height - 1 // reserve space for status bar
@@ -223,7 +327,30 @@ func (t *TUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	case tea.KeyMsg:
-		if t.selectMode {
+		t.inputErr = nil
+		if t.breakpointMode || t.editMode {
+			switch msg.String() {
+			case "esc":
+				t.breakpointMode = false
+				t.editMode = false
+			case "enter":
+				value := strings.TrimSpace(t.input.Value())
+				if t.breakpointMode {
+					t.breakpointMode = false
+					if value != "" {
+						t.breakpoints.toggle(value)
+					}
+				} else if t.selected != nil {
+					if err := t.releaseEdited(*t.selected, value); err != nil {
+						t.inputErr = err
+					} else {
+						t.editMode = false
+					}
+				}
+			case "ctrl+c":
+				return t, tea.Quit
+			}
+		} else if t.selectMode {
 			switch msg.String() {
 			case "esc":
 				t.selectMode = false
@@ -256,13 +383,49 @@ func (t *TUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			case "s":
 				// Don't accept s/select until at least one function
 				// call has been received.
-				if len(t.calls) > 0 && t.err == nil {
+				t.mu.Lock()
+				canSelect := len(t.calls) > 0 && t.err == nil && t.connectionState != unauthorized
+				t.mu.Unlock()
+				if canSelect {
 					cmds = append(cmds, focusSelect)
 				}
 			case "t":
 				t.tailMode = true
 			case "v":
 				Verbose = true
+			case "b":
+				if t.breakpoints == nil {
+					break
+				}
+				if t.activeTab == detailTab {
+					// Toggle the breakpoint on the function of the selected
+					// function call.
+					t.mu.Lock()
+					n := t.calls[*t.selected]
+					t.mu.Unlock()
+					t.breakpoints.toggle(n.function())
+				} else if t.activeTab == functionsTab {
+					cmds = append(cmds, focusBreakpoint)
+				}
+			case "r":
+				if t.activeTab == detailTab && t.breakpoints != nil {
+					t.breakpoints.release(*t.selected, nil)
+				}
+			case "x":
+				if t.activeTab == detailTab && t.breakpoints != nil {
+					t.breakpoints.skip(*t.selected)
+				}
+			case "e":
+				if t.activeTab == detailTab && t.breakpoints != nil {
+					if req := t.breakpoints.pausedRequest(*t.selected); req != nil {
+						input, err := inputJSON(req)
+						if err != nil {
+							t.inputErr = err
+							break
+						}
+						cmds = append(cmds, focusEdit(input))
+					}
+				}
 			case "tab":
 				t.selectMode = false
 				t.activeTab = (t.activeTab + 1) % tabCount
@@ -284,6 +447,12 @@ func (t *TUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			cmds = append(cmds, cmd)
 		}
 	}
+	if t.breakpointMode || t.editMode {
+		t.input, cmd = t.input.Update(msg)
+		if cmd != nil {
+			cmds = append(cmds, cmd)
+		}
+	}
 
 	// Forward messages to the viewport, e.g. for scroll-back support.
 	t.viewport, cmd = t.viewport.Update(msg)
@@ -318,7 +487,13 @@ func (t *TUI) View() string {
 		case functionsTab:
 			if len(t.roots) == 0 {
 				viewportContent = t.logoView()
-				statusBarContent = "Waiting for function calls..."
+				if t.waitingForApplication {
+					statusBarContent = "Waiting for application..."
+				} else if t.connectionState == reconnecting {
+					statusBarContent = retryStyle.Render("Reconnecting to Dispatch...")
+				} else {
+					statusBarContent = "Waiting for function calls..."
+				}
 				helpContent = t.logoHelp
 			} else {
 				viewportContent = t.functionsView(time.Now())
@@ -334,22 +509,62 @@ func (t *TUI) View() string {
 					}
 				}
 				statusBarContent += fmt.Sprintf(", %d in-flight", inflightCount)
+				if t.limiter != nil && t.limiter.max > 0 {
+					concurrent, queued := t.limiter.counts()
+					statusBarContent += fmt.Sprintf(", %d/%d concurrent requests", concurrent, t.limiter.max)
+					if queued > 0 {
+						statusBarContent += fmt.Sprintf(", %d queued", queued)
+					}
+				}
+				if t.waitingForApplication {
+					statusBarContent += ", waiting for application..."
+				}
+				if t.connectionState == reconnecting {
+					statusBarContent += ", " + retryStyle.Render("reconnecting to Dispatch...")
+				}
 				helpContent = t.functionsTabHelp
 			}
+			if t.breakpoints != nil {
+				if functions := t.breakpoints.list(); len(functions) > 0 {
+					statusBarContent += ", " + pausedStyle.Render("breakpoints: "+strings.Join(functions, ", "))
+				}
+			}
 			if t.selectMode {
 				statusBarContent = t.selection.View()
 				helpContent = t.selectHelp
 			}
+			if t.breakpointMode {
+				statusBarContent = t.input.View()
+				helpContent = t.breakpointHelp
+			}
 		case detailTab:
 			id := *t.selected
 			viewportContent = t.detailView(id)
 			helpContent = t.detailTabHelp
+			if t.breakpoints.isPaused(id) {
+				statusBarContent = pausedStyle.Render("Paused at breakpoint")
+				helpContent = t.pausedHelp
+			}
+			if t.editMode {
+				statusBarContent = t.input.View()
+				helpContent = t.editHelp
+			}
+			if t.inputErr != nil {
+				statusBarContent = errorStyle.Render(t.inputErr.Error())
+			}
 		case logsTab:
 			viewportContent = t.logs.String()
 			helpContent = t.logsTabHelp
 		}
 	}
 
+	if t.draining && t.limiter != nil {
+		inflight, queued := t.limiter.counts()
+		statusBarContent = retryStyle.Render(fmt.Sprintf("Shutting down, waiting for %d in-flight function calls...", inflight+queued))
+	}
+	if t.connectionState == unauthorized && t.connectionErr != nil {
+		statusBarContent = errorStyle.Render(t.connectionErr.Error())
+	}
 	if t.err != nil {
 		statusBarContent = errorStyle.Render(t.err.Error())
 	}
@@ -413,6 +628,9 @@ func (t *TUI) logoView() string {
 		}
 		b.WriteByte('\n')
 	}
+	if t.endpoint != "" {
+		b.WriteString("\n" + detailHeaderStyle.Render("Local application endpoint: ") + t.endpoint + "\n")
+	}
 	return b.String()
 }
 
@@ -507,7 +725,11 @@ func (t *TUI) detailView(id DispatchID) string {
 
 	n := t.calls[id]
 
-	style, _, status := n.status(now)
+	style, _, status := n.status()
+	paused := t.breakpoints.isPaused(id)
+	if paused {
+		style, status = pausedStyle, "Paused"
+	}
 
 	var view strings.Builder
 
@@ -571,7 +793,11 @@ func (t *TUI) detailView(id DispatchID) string {
 		}
 
 		if rt.response.ts.IsZero() {
-			add("Status", "Running")
+			if paused && rt == n.timeline[len(n.timeline)-1] {
+				add("Status", pausedStyle.Render("Paused at breakpoint"))
+			} else {
+				add("Status", "Running")
+			}
 		} else {
 			if res := rt.response.proto; res != nil {
 				switch d := res.Directive.(type) {
@@ -640,7 +866,13 @@ func (t *TUI) detailView(id DispatchID) string {
 				}
 				add("Error", style.Render(fmt.Sprintf("%d %s", c, http.StatusText(c))))
 			} else if rt.response.err != nil {
-				add("Error", retryStyle.Render(rt.response.err.Error()))
+				style := retryStyle
+				if errors.As(rt.response.err, &expiredError{}) {
+					style = errorStyle
+				} else if errors.As(rt.response.err, &callTimeoutError{}) {
+					add("Status", retryStyle.Render(statusString(sdkv1.Status_STATUS_TIMEOUT)))
+				}
+				add("Error", style.Render(rt.response.err.Error()))
 			}
 
 			latency := rt.response.ts.Sub(rt.request.ts)
@@ -701,7 +933,10 @@ func (t *TUI) buildRows(now time.Time, id DispatchID, isLast []bool, rows *rowBu
 		function.WriteByte(' ')
 	}
 
-	style, icon, status := n.status(now)
+	style, icon, status := n.status()
+	if t.breakpoints.isPaused(id) {
+		style, status = pausedStyle, "Paused"
+	}
 
 	function.WriteString(style.Render(n.function()))
 
@@ -748,6 +983,9 @@ type functionCall struct {
 type roundtrip struct {
 	request  runRequest
 	response runResponse
+	// paused is true if the request is paused at a breakpoint, and
+	// hasn't been observed yet.
+	paused bool
 }
 
 type runRequest struct {
@@ -771,7 +1009,7 @@ func (n *functionCall) function() string {
 	return "(?)"
 }
 
-func (n *functionCall) status(now time.Time) (style lipgloss.Style, icon, status string) {
+func (n *functionCall) status() (style lipgloss.Style, icon, status string) {
 	icon = pendingIcon
 	if n.running {
 		style = pendingStyle
@@ -785,12 +1023,6 @@ func (n *functionCall) status(now time.Time) (style lipgloss.Style, icon, status
 			style = errorStyle
 			icon = failureIcon
 		}
-	} else if !n.expirationTime.IsZero() && n.expirationTime.Before(now) {
-		n.lastError = errors.New("Expired")
-		style = errorStyle
-		n.done = true
-		n.doneTime = n.expirationTime
-		icon = failureIcon
 	} else if n.failures > 0 {
 		style = retryStyle
 	} else {
@@ -848,6 +1080,21 @@ func (t *TUI) ObserveRequest(now time.Time, req *sdkv1.RunRequest) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	t.observeRequest(now, req, false)
+}
+
+// observePaused shows a function call that's paused at a breakpoint. The
+// request is observed again when the call is released, and replaces the
+// paused one, since its input may have been edited.
+func (t *TUI) observePaused(now time.Time, req *sdkv1.RunRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.observeRequest(now, req, true)
+}
+
+func (t *TUI) observeRequest(now time.Time, req *sdkv1.RunRequest, paused bool) {
+
 	if t.roots == nil {
 		t.roots = map[DispatchID]struct{}{}
 	}
@@ -887,7 +1134,12 @@ func (t *TUI) ObserveRequest(now time.Time, req *sdkv1.RunRequest) {
 	if req.ExpirationTime != nil {
 		n.expirationTime = req.ExpirationTime.AsTime()
 	}
-	n.timeline = append(n.timeline, &roundtrip{request: runRequest{ts: now, proto: req}})
+	rt := &roundtrip{request: runRequest{ts: now, proto: req}, paused: paused}
+	if last := len(n.timeline) - 1; last >= 0 && n.timeline[last].paused {
+		n.timeline[last] = rt
+	} else {
+		n.timeline = append(n.timeline, rt)
+	}
 	t.calls[id] = n
 
 	// Upsert the parent and link its child, if applicable.
@@ -968,7 +1220,19 @@ func (t *TUI) ObserveResponse(now time.Time, req *sdkv1.RunRequest, err error, h
 		n.done = terminalHTTPStatusCode(httpRes.StatusCode)
 	} else if err != nil {
 		n.failures++
-		n.lastError = err
+		var expired expiredError
+		if errors.As(err, &expired) {
+			// Dispatch doesn't retry calls that have expired.
+			n.lastError = err
+			n.done = true
+			n.doneTime = expired.expirationTime
+		} else if errors.As(err, &callTimeoutError{}) {
+			// Report timeouts as a status rather than an error, similar
+			// to how Dispatch reports functions that time out.
+			n.lastStatus = sdkv1.Status_STATUS_TIMEOUT
+		} else {
+			n.lastError = err
+		}
 	}
 
 	if n.done && n.doneTime.IsZero() {
@@ -978,6 +1242,42 @@ func (t *TUI) ObserveResponse(now time.Time, req *sdkv1.RunRequest, err error, h
 	t.calls[id] = n
 }
 
+// expireCalls marks the function calls that expired while waiting to be
+// retried as done. Dispatch doesn't retry calls that have expired, and no
+// response is observed for them.
+func (t *TUI) expireCalls(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, n := range t.calls {
+		if n.done || n.running || n.suspended || n.failures == 0 {
+			continue
+		}
+		if n.expirationTime.IsZero() || n.expirationTime.After(now) {
+			continue
+		}
+		n.lastError = errors.New("Expired while waiting to be retried")
+		n.done = true
+		n.doneTime = n.expirationTime
+		t.calls[id] = n
+	}
+}
+
+// releaseEdited releases a function call paused at a breakpoint, with the
+// input edited as JSON.
+func (t *TUI) releaseEdited(id DispatchID, value string) error {
+	req := t.breakpoints.pausedRequest(id)
+	if req == nil {
+		return nil // released in the meantime
+	}
+	input, err := parseInputJSON(req.GetInput(), value)
+	if err != nil {
+		return err
+	}
+	t.breakpoints.release(id, input)
+	return nil
+}
+
 func (t *TUI) Write(b []byte) (int, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -999,6 +1299,34 @@ func (t *TUI) SetError(err error) {
 	t.err = err
 }
 
+// SetWaitingForApplication is called when the CLI starts and stops waiting
+// for the local application to be ready.
+func (t *TUI) SetWaitingForApplication(waiting bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.waitingForApplication = waiting
+}
+
+// SetDraining is called when the CLI starts and stops waiting for
+// in-flight function calls to complete before shutting down.
+func (t *TUI) SetDraining(draining bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.draining = draining
+}
+
+// SetConnectionState is called by the pollers when the state of the
+// connection to the Dispatch API changes.
+func (t *TUI) SetConnectionState(state connectionState, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.connectionState = state
+	t.connectionErr = err
+}
+
 func statusString(status sdkv1.Status) string {
 	switch status {
 	case sdkv1.Status_STATUS_OK:
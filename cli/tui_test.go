@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	sdkv1 "buf.build/gen/go/stealthrocket/dispatch-proto/protocolbuffers/go/dispatch/sdk/v1"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestTUIBreakpoints(t *testing.T) {
+	bp := newBreakpoints()
+	tui := &TUI{breakpoints: bp}
+	bp.onPause = tui.observePaused
+	tui.Init()
+	tui.Update(tea.WindowSizeMsg{Width: 120, Height: 40})
+
+	// update processes a message, and the messages of the commands that
+	// it returns, which are expected to complete immediately.
+	var update func(msg tea.Msg)
+	update = func(msg tea.Msg) {
+		_, cmd := tui.Update(msg)
+		if cmd == nil {
+			return
+		}
+		switch msg := cmd().(type) {
+		case focusBreakpointMsg, focusEditMsg:
+			update(msg)
+		}
+	}
+	typeText := func(s string) {
+		for _, r := range s {
+			update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+		}
+	}
+
+	// Set a breakpoint from the functions tab.
+	update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("b")})
+	assert.True(t, tui.breakpointMode)
+	typeText("work")
+	update(tea.KeyMsg{Type: tea.KeyEnter})
+	assert.False(t, tui.breakpointMode)
+	assert.Equal(t, []string{"work"}, bp.list())
+
+	// Pause a function call at the breakpoint.
+	input, err := anypb.New(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &sdkv1.RunRequest{Function: "work", DispatchId: "1", RootDispatchId: "1", Directive: &sdkv1.RunRequest_Input{Input: input}}
+
+	edited := make(chan *anypb.Any, 1)
+	go func() {
+		logger := slog.New(&slogHandler{stream: io.Discard})
+		_, input, _ := bp.wait(context.Background(), req, logger)
+		edited <- input
+	}()
+	assert.Eventually(t, func() bool { return bp.isPaused("1") }, time.Second, time.Millisecond)
+	assert.Contains(t, tui.View(), "Paused")
+
+	// Edit the input from the detail tab, and release the call.
+	id := DispatchID("1")
+	tui.selected = &id
+	tui.activeTab = detailTab
+	update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("e")})
+	assert.True(t, tui.editMode)
+	assert.Equal(t, `"hello"`, tui.input.Value())
+
+	tui.input.SetValue(`"world"`)
+	update(tea.KeyMsg{Type: tea.KeyEnter})
+	assert.False(t, tui.editMode)
+
+	releasedInput := <-edited
+	var output wrapperspb.StringValue
+	if err := releasedInput.UnmarshalTo(&output); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "world", output.Value)
+	assert.False(t, bp.isPaused("1"))
+
+	// The released request replaces the paused one.
+	released := proto.Clone(req).(*sdkv1.RunRequest)
+	released.Directive = &sdkv1.RunRequest_Input{Input: releasedInput}
+	tui.ObserveRequest(time.Now(), released)
+	n := tui.calls[id]
+	if assert.Len(t, n.timeline, 1) {
+		assert.Same(t, released, n.timeline[0].request.proto)
+	}
+	assert.Contains(t, tui.detailView(id), "world")
+}
+
+func TestTUIEndpoint(t *testing.T) {
+	tui := &TUI{endpoint: "http://127.0.0.1:8123"}
+	tui.Init()
+	tui.Update(tea.WindowSizeMsg{Width: 120, Height: 40})
+	assert.Contains(t, tui.View(), "Local application endpoint: http://127.0.0.1:8123")
+
+	tui = &TUI{}
+	tui.Init()
+	tui.Update(tea.WindowSizeMsg{Width: 120, Height: 40})
+	assert.NotContains(t, tui.View(), "Local application endpoint")
+}
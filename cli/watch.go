@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchDebounce is how long the file watcher waits for changes to settle
+// before reporting them. Editors often write files in multiple steps, and
+// a single save should only restart the local application once.
+const watchDebounce = 200 * time.Millisecond
+
+// validateWatchPatterns checks that the --watch patterns are well formed.
+func validateWatchPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		for _, segment := range strings.Split(filepath.ToSlash(pattern), "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid watch pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchWatchPattern reports whether a file path, relative to the directory
+// being watched, matches a --watch pattern.
+//
+// Patterns without a slash match file names in any directory, e.g. "*.py".
+// Other patterns match the whole path, and "**" matches any number of
+// directories, e.g. "src/**/*.py".
+func matchWatchPattern(pattern, name string) bool {
+	pattern = filepath.ToSlash(pattern)
+	name = filepath.ToSlash(name)
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	pattern = strings.TrimPrefix(pattern, "./")
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// ignoreWatchDir reports whether a directory should not be watched. Hidden
+// directories (e.g. .git or .venv) and directories of generated files are
+// skipped, since they can be large and change often.
+func ignoreWatchDir(name string) bool {
+	switch name {
+	case "__pycache__", "node_modules":
+		return true
+	}
+	return len(name) > 1 && strings.HasPrefix(name, ".")
+}
+
+// walkWatchDirs calls fn for each directory under root that should be
+// watched, including root itself.
+func walkWatchDirs(root string, fn func(dir string)) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // e.g. the directory was removed
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && ignoreWatchDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		fn(path)
+		return nil
+	})
+}
+
+// watchFiles watches the files under root, and calls onChange with the
+// path of a file that matches one of the patterns when files have changed.
+// It returns when the context is canceled.
+func watchFiles(ctx context.Context, root string, patterns []string, onChange func(path string)) error {
+	changes := make(chan string, 64)
+	errs := make(chan error, 1)
+	go func() { errs <- watchTree(ctx, root, changes) }()
+
+	var changed string
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return <-errs
+		case err := <-errs:
+			return err
+		case name := <-changes:
+			rel, err := filepath.Rel(root, name)
+			if err != nil {
+				rel = name
+			}
+			for _, pattern := range patterns {
+				if matchWatchPattern(pattern, rel) {
+					changed = rel
+					debounce = time.After(watchDebounce)
+					break
+				}
+			}
+		case <-debounce:
+			debounce = nil
+			onChange(changed)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//go:build !linux
+
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const watchPollInterval = 500 * time.Millisecond
+
+// watchTree sends the paths of files that change under root to the
+// changes channel, until the context is canceled.
+//
+// File system notifications are only used on Linux. On other platforms,
+// the modification times of files are polled instead.
+func watchTree(ctx context.Context, root string, changes chan<- string) error {
+	scan := func() map[string]time.Time {
+		files := map[string]time.Time{}
+		_ = walkWatchDirs(root, func(dir string) {
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				if entry.IsDir() {
+					continue
+				}
+				if info, err := entry.Info(); err == nil {
+					files[filepath.Join(dir, entry.Name())] = info.ModTime()
+				}
+			}
+		})
+		return files
+	}
+
+	files := scan()
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		var changed []string
+		latest := scan()
+		for name, modTime := range latest {
+			if prev, ok := files[name]; !ok || !prev.Equal(modTime) {
+				changed = append(changed, name)
+			}
+		}
+		for name := range files {
+			if _, ok := latest[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+		files = latest
+
+		for _, name := range changed {
+			select {
+			case changes <- name:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
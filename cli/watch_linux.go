@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// watchTree sends the paths of files that change under root to the
+// changes channel, until the context is canceled.
+func watchTree(ctx context.Context, root string, changes chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to watch files: %v", err)
+	}
+	// The file descriptor is non-blocking, so reads can be interrupted
+	// by closing the file.
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	dirs := map[int32]string{}
+	addWatches := func(root string) error {
+		return walkWatchDirs(root, func(dir string) {
+			wd, err := syscall.InotifyAddWatch(fd, dir, inotifyMask)
+			if err == nil {
+				dirs[int32(wd)] = dir
+			}
+		})
+	}
+	if err := addWatches(root); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to watch files: %v", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to watch files: %v", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			dir, ok := dirs[event.Wd]
+			if !ok {
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(dirs, event.Wd)
+				continue
+			}
+			name := filepath.Join(dir, string(trimNUL(nameBytes)))
+
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				// Watch new directories, e.g. when a package is added.
+				if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && !ignoreWatchDir(filepath.Base(name)) {
+					_ = addWatches(name)
+				}
+				continue
+			}
+
+			select {
+			case changes <- name:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func trimNUL(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchWatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.py", "main.py", true},
+		{"*.py", "app/models/user.py", true},
+		{"*.py", "main.go", false},
+		{"app/*.py", "app/main.py", true},
+		{"app/*.py", "app/models/user.py", false},
+		{"./app/*.py", "app/main.py", true},
+		{"app/**/*.py", "app/main.py", true},
+		{"app/**/*.py", "app/models/user.py", true},
+		{"app/**/*.py", "lib/user.py", false},
+		{"**/test_*.py", "tests/unit/test_user.py", true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.match, matchWatchPattern(test.pattern, test.path), "%s %s", test.pattern, test.path)
+	}
+
+	assert.NoError(t, validateWatchPatterns([]string{"*.py", "src/**/*.go"}))
+	assert.Error(t, validateWatchPatterns([]string{"[*.py"}))
+}
+
+func TestWatchFiles(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "app"), 0755))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changes := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- watchFiles(ctx, root, []string{"*.py"}, func(path string) { changes <- path })
+	}()
+
+	// Keep writing files until the watcher has started and reports a
+	// change, since there's no way to know when it's ready.
+	ticker := time.NewTicker(4 * watchDebounce)
+	defer ticker.Stop()
+	for {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, "app", "ignored.txt"), []byte("x"), 0644))
+		assert.NoError(t, os.WriteFile(filepath.Join(root, "app", "main.py"), []byte("x"), 0644))
+
+		select {
+		case path := <-changes:
+			assert.Equal(t, filepath.Join("app", "main.py"), path)
+			cancel()
+			assert.NoError(t, <-done)
+			return
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.Fatal("file changes were not reported")
+		}
+	}
+}